@@ -0,0 +1,99 @@
+// Package bus publishes changes to an emulated light to any number of
+// listeners without ever blocking the publisher.
+package bus
+
+import (
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"sync"
+)
+
+type (
+	// Light is the complete state of a light after a change, so a listener
+	// that misses some changes loses nothing but the steps in between.
+	Light struct {
+		PowerLevel uint16
+		Color      controlifx.HSBK
+
+		// Duration is how long the change takes, in milliseconds.
+		Duration uint32
+	}
+
+	Bus struct {
+		mu   sync.Mutex
+		subs map[*Subscription]struct{}
+		last *Light
+	}
+
+	// Subscription receives changes on C. When its buffer is full the oldest
+	// change is discarded to make room, so a slow listener only ever falls
+	// behind by the size of its buffer.
+	Subscription struct {
+		C <-chan Light
+		c chan Light
+	}
+)
+
+func New() *Bus {
+	return &Bus{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe returns a subscription buffering up to size changes. The latest
+// change, if any, is delivered straight away.
+func (o *Bus) Subscribe(size int) *Subscription {
+	if size < 1 {
+		size = 1
+	}
+
+	c := make(chan Light, size)
+	sub := &Subscription{
+		C: c,
+		c: c,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.subs[sub] = struct{}{}
+	if o.last != nil {
+		sub.c <- *o.last
+	}
+
+	return sub
+}
+
+// Unsubscribe stops deliveries to sub and closes its channel.
+func (o *Bus) Unsubscribe(sub *Subscription) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.subs[sub]; ok {
+		delete(o.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Publish delivers l to every subscriber without blocking.
+func (o *Bus) Publish(l Light) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.last = &l
+
+	for sub := range o.subs {
+		for {
+			select {
+			case sub.c <- l:
+			default:
+				// Full, so make room by dropping the oldest change.
+				select {
+				case <-sub.c:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package bus
+
+import (
+	"testing"
+	"time"
+)
+
+// drain returns the power levels of the changes waiting on sub.
+func drain(sub *Subscription) []uint16 {
+	var levels []uint16
+	for {
+		select {
+		case l, ok := <-sub.C:
+			if !ok {
+				return levels
+			}
+			levels = append(levels, l.PowerLevel)
+		default:
+			return levels
+		}
+	}
+}
+
+func TestPublishNeverBlocks(t *testing.T) {
+	b := New()
+	b.Subscribe(1)
+	b.Subscribe(4)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			b.Publish(Light{PowerLevel: uint16(i)})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on subscribers that never read")
+	}
+}
+
+func TestFullSubscriberDropsOldest(t *testing.T) {
+	for _, test := range []struct {
+		size      int
+		published int
+		want      []uint16
+	}{
+		{1, 3, []uint16{2}},
+		{3, 2, []uint16{0, 1}},
+		{3, 5, []uint16{2, 3, 4}},
+		{0, 2, []uint16{1}},
+	} {
+		b := New()
+		sub := b.Subscribe(test.size)
+
+		for i := 0; i < test.published; i++ {
+			b.Publish(Light{PowerLevel: uint16(i)})
+		}
+
+		got := drain(sub)
+		if len(got) != len(test.want) {
+			t.Errorf("size %d after %d changes: got %v, want %v", test.size, test.published, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("size %d after %d changes: got %v, want %v", test.size, test.published, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSubscribeReplaysLast(t *testing.T) {
+	b := New()
+
+	if got := drain(b.Subscribe(1)); len(got) != 0 {
+		t.Errorf("subscribing before any change got %v, want nothing", got)
+	}
+
+	b.Publish(Light{PowerLevel: 1})
+	b.Publish(Light{PowerLevel: 2})
+
+	if got := drain(b.Subscribe(4)); len(got) != 1 || got[0] != 2 {
+		t.Errorf("subscribing after changes got %v, want [2]", got)
+	}
+}
+
+func TestUnsubscribeClosesOnce(t *testing.T) {
+	b := New()
+	sub := b.Subscribe(1)
+
+	b.Unsubscribe(sub)
+	b.Unsubscribe(sub)
+	b.Publish(Light{PowerLevel: 1})
+
+	select {
+	case _, ok := <-sub.C:
+		if ok {
+			t.Error("got a change after unsubscribing")
+		}
+	default:
+		t.Error("C isn't closed after unsubscribing")
+	}
+}
@@ -0,0 +1,128 @@
+// Package clock abstracts time so that the emulator can be driven by a fake
+// clock in tests.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	Clock interface {
+		Now() time.Time
+		After(d time.Duration) <-chan time.Time
+		AfterFunc(d time.Duration, f func()) Timer
+	}
+
+	Timer interface {
+		Stop() bool
+	}
+
+	realClock struct{}
+
+	// Fake is a Clock that only moves when told to. Timers fire, in order,
+	// from the goroutine that advances it.
+	Fake struct {
+		mu     sync.Mutex
+		now    time.Time
+		timers []*fakeTimer
+	}
+
+	fakeTimer struct {
+		clock *Fake
+		when  time.Time
+		f     func()
+	}
+)
+
+// Real is the wall clock.
+var Real Clock = realClock{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (o *Fake) Now() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.now
+}
+
+func (o *Fake) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	o.AfterFunc(d, func() {
+		ch <- o.Now()
+	})
+
+	return ch
+}
+
+func (o *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t := &fakeTimer{
+		clock: o,
+		when:  o.now.Add(d),
+		f:     f,
+	}
+	o.timers = append(o.timers, t)
+
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due on
+// the way at its own time.
+func (o *Fake) Advance(d time.Duration) {
+	o.mu.Lock()
+	end := o.now.Add(d)
+	o.mu.Unlock()
+
+	for {
+		o.mu.Lock()
+		sort.SliceStable(o.timers, func(i, j int) bool {
+			return o.timers[i].when.Before(o.timers[j].when)
+		})
+
+		if len(o.timers) == 0 || o.timers[0].when.After(end) {
+			o.now = end
+			o.mu.Unlock()
+			return
+		}
+
+		t := o.timers[0]
+		o.timers = o.timers[1:]
+		o.now = t.when
+		o.mu.Unlock()
+
+		t.f()
+	}
+}
+
+func (o *fakeTimer) Stop() bool {
+	o.clock.mu.Lock()
+	defer o.clock.mu.Unlock()
+
+	for i, t := range o.clock.timers {
+		if t == o {
+			o.clock.timers = append(o.clock.timers[:i], o.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAdvance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := NewFake(start)
+
+	var fired []time.Duration
+	record := func() {
+		fired = append(fired, clk.Now().Sub(start))
+	}
+
+	clk.AfterFunc(3*time.Second, record)
+	clk.AfterFunc(1*time.Second, record)
+	stopped := clk.AfterFunc(2*time.Second, record)
+	clk.AfterFunc(10*time.Second, record)
+
+	if !stopped.Stop() {
+		t.Fatal("Stop() = false for a pending timer")
+	}
+
+	clk.Advance(5 * time.Second)
+
+	want := []time.Duration{1 * time.Second, 3 * time.Second}
+	if len(fired) != len(want) {
+		t.Fatalf("fired at %v, want %v", fired, want)
+	}
+	for i := range want {
+		if fired[i] != want[i] {
+			t.Fatalf("fired at %v, want %v", fired, want)
+		}
+	}
+
+	if got := clk.Now().Sub(start); got != 5*time.Second {
+		t.Errorf("Now() is %v after start, want 5s", got)
+	}
+	if stopped.Stop() {
+		t.Error("Stop() = true for a stopped timer")
+	}
+}
+
+func TestFakeAdvanceTimerSetByTimer(t *testing.T) {
+	clk := NewFake(time.Unix(0, 0))
+
+	var at time.Time
+	clk.AfterFunc(time.Second, func() {
+		clk.AfterFunc(time.Second, func() {
+			at = clk.Now()
+		})
+	})
+
+	clk.Advance(3 * time.Second)
+
+	if want := time.Unix(2, 0); !at.Equal(want) {
+		t.Errorf("chained timer fired at %v, want %v", at, want)
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	clk := NewFake(time.Unix(0, 0))
+	ch := clk.After(time.Minute)
+
+	clk.Advance(time.Minute - 1)
+	select {
+	case <-ch:
+		t.Fatal("After fired early")
+	default:
+	}
+
+	clk.Advance(1)
+	select {
+	case now := <-ch:
+		if want := time.Unix(60, 0); !now.Equal(want) {
+			t.Errorf("After sent %v, want %v", now, want)
+		}
+	default:
+		t.Fatal("After didn't fire")
+	}
+}
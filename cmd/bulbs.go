@@ -1,32 +1,49 @@
 package cmd
 
 import (
+	"context"
 	"github.com/bionicrm/emulifx/server"
 	"github.com/spf13/cobra"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
 	colorCmd = &cobra.Command{
 		Use:   "color",
 		Short: "emulates the LIFX Color 1000 bulb",
-		Run: func(cmd *cobra.Command, args []string) {
-			if err := server.Start(addr, true); err != nil {
-				log.Fatalln(err)
-			}
-		},
+		Run:   runBulb(true),
 	}
 	whiteCmd = &cobra.Command{
 		Use:   "white",
 		Short: "emulates the LIFX White 800 bulb",
-		Run: func(cmd *cobra.Command, args []string) {
-			if err := server.Start(addr, false); err != nil {
-				log.Fatalln(err)
-			}
-		},
+		Run:   runBulb(false),
 	}
 )
 
 func init() {
 	RootCmd.AddCommand(colorCmd, whiteCmd)
 }
+
+func runBulb(hasColor bool) func(cmd *cobra.Command, args []string) {
+	return func(cmd *cobra.Command, args []string) {
+		cfg, err := loadConfig(cmd, hasColor)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		ctx, stop := signalContext()
+		defer stop()
+
+		if err := server.Start(ctx, cfg); err != nil {
+			log.Fatalln(err)
+		}
+	}
+}
+
+// signalContext returns a context that is done on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/bionicrm/emulifx/server"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+)
+
+// settings copies each flag into a server.Config.
+var settings = map[string]func(cfg *server.Config) error{
+	"addr": func(cfg *server.Config) error {
+		cfg.Addr = addr
+		return nil
+	},
+	"mac": func(cfg *server.Config) (err error) {
+		cfg.MAC = 0
+		if mac != "" {
+			cfg.MAC, err = server.ParseMAC(mac)
+		}
+		return
+	},
+	"random-mac": func(cfg *server.Config) error {
+		cfg.RandomMAC = randomMAC
+		return nil
+	},
+	"metrics-addr": func(cfg *server.Config) error {
+		cfg.MetricsAddr = metricsAddr
+		return nil
+	},
+	"control-addr": func(cfg *server.Config) error {
+		cfg.ControlAddr = controlAddr
+		return nil
+	},
+	"state": func(cfg *server.Config) error {
+		cfg.StatePath = statePath
+		return nil
+	},
+	"outage": func(cfg *server.Config) error {
+		cfg.Outages = make([]server.Outage, len(outages))
+		for i, s := range outages {
+			if err := cfg.Outages[i].UnmarshalText([]byte(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"boot-time": func(cfg *server.Config) error {
+		cfg.BootTime = bootTime
+		return nil
+	},
+	"power-on": func(cfg *server.Config) error {
+		return cfg.PowerOn.UnmarshalText([]byte(powerOn))
+	},
+	"strict": func(cfg *server.Config) error {
+		cfg.Strict = strict
+		return nil
+	},
+	"headless": func(cfg *server.Config) error {
+		cfg.Headless = headless
+		return nil
+	},
+	"workers": func(cfg *server.Config) error {
+		cfg.Workers = workers
+		return nil
+	},
+	"trace": func(cfg *server.Config) error {
+		cfg.Trace = trace
+		return nil
+	},
+	"rssi": func(cfg *server.Config) error {
+		cfg.RSSI = rssi
+		return nil
+	},
+	"drift": func(cfg *server.Config) error {
+		cfg.Drift = drift
+		return nil
+	},
+	"signal": func(cfg *server.Config) error {
+		cfg.Signal.Points = make([]server.SignalPoint, len(signalPoints))
+		for i, s := range signalPoints {
+			if err := cfg.Signal.Points[i].UnmarshalText([]byte(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"signal-walk": func(cfg *server.Config) error {
+		cfg.Signal.Walk = signalWalk
+		return nil
+	},
+	"signal-spread": func(cfg *server.Config) error {
+		cfg.Signal.Spread = signalSpread
+		return nil
+	},
+	"signal-loss": func(cfg *server.Config) error {
+		cfg.Signal.Loss = signalLoss
+		return nil
+	},
+	"profile": func(cfg *server.Config) error {
+		return cfg.Profile.UnmarshalText([]byte(profile))
+	},
+	"lux": func(cfg *server.Config) error {
+		cfg.AmbientLux = ambientLux
+		return nil
+	},
+	"day": func(cfg *server.Config) error {
+		cfg.Day = day
+		return nil
+	},
+	"dimmer-voltage": func(cfg *server.Config) error {
+		cfg.DimmerVoltage = dimmer
+		return nil
+	},
+	"unconfigured": func(cfg *server.Config) error {
+		cfg.Unconfigured = onboarding
+		return nil
+	},
+	"cloud-connected": func(cfg *server.Config) error {
+		cfg.CloudConnected = cloud
+		return nil
+	},
+	"cloud-addr": func(cfg *server.Config) error {
+		cfg.CloudAddr = cloudAddr
+		return nil
+	},
+	"log-unknown": func(cfg *server.Config) error {
+		cfg.LogUnknown = logUnknown
+		return nil
+	},
+	"canned": func(cfg *server.Config) error {
+		cfg.Canned = make([]server.CannedResponse, len(canned))
+		for i, s := range canned {
+			if err := cfg.Canned[i].UnmarshalText([]byte(s)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"clock-skew": func(cfg *server.Config) error {
+		cfg.ClockSkew = clockSkew
+		return nil
+	},
+	"throttle-rate": func(cfg *server.Config) error {
+		cfg.Throttle.Rate = throttle.Rate
+		return nil
+	},
+	"throttle-depth": func(cfg *server.Config) error {
+		cfg.Throttle.Depth = throttle.Depth
+		return nil
+	},
+	"fault-seed": func(cfg *server.Config) error {
+		cfg.Faults.Seed = faults.Seed
+		return nil
+	},
+	"fault-drop": func(cfg *server.Config) error {
+		cfg.Faults.Drop = faults.Drop
+		return nil
+	},
+	"fault-delay": func(cfg *server.Config) error {
+		cfg.Faults.Delay = faults.Delay
+		return nil
+	},
+	"fault-jitter": func(cfg *server.Config) error {
+		cfg.Faults.Jitter = faults.Jitter
+		return nil
+	},
+	"fault-duplicate": func(cfg *server.Config) error {
+		cfg.Faults.Duplicate = faults.Duplicate
+		return nil
+	},
+	"fault-reorder": func(cfg *server.Config) error {
+		cfg.Faults.Reorder = faults.Reorder
+		return nil
+	},
+}
+
+// loadConfig builds the server configuration from the flag defaults, then the
+// config file, if any, and finally the flags that were set explicitly.
+func loadConfig(cmd *cobra.Command, hasColor bool) (cfg server.Config, err error) {
+	flags := cmd.Flags()
+
+	for _, set := range settings {
+		if err = set(&cfg); err != nil {
+			return
+		}
+	}
+
+	if configPath != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(configPath); err != nil {
+			return
+		}
+		if err = json.Unmarshal(b, &cfg); err != nil {
+			return
+		}
+
+		for name, set := range settings {
+			if !flags.Changed(name) {
+				continue
+			}
+			if err = set(&cfg); err != nil {
+				return
+			}
+		}
+	}
+
+	cfg.HasColor = hasColor
+
+	return
+}
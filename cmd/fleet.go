@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/bionicrm/emulifx/server"
+	"github.com/spf13/cobra"
+	"log"
+	"net"
+)
+
+var (
+	fleetCmd = &cobra.Command{
+		Use:   "fleet",
+		Short: "emulates several headless bulbs, each on its own address at port 56700",
+		Long: `Emulates several headless bulbs, each bound to port 56700 of its own address,
+starting at --base-ip and counting up. Broadcast discovery reaches all of them,
+as on a real LAN.
+
+Every address must belong to this host. On Linux all of 127.0.0.0/8 already
+does; elsewhere, add aliases first, e.g. "ifconfig lo0 alias 127.0.0.2".`,
+		Run: func(cmd *cobra.Command, args []string) {
+			ips, err := fleetIPs(fleetBaseIP, fleetCount)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			cfg, err := loadConfig(cmd, !fleetWhite)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			ctx, stop := signalContext()
+			defer stop()
+
+			if err := server.StartFleet(ctx, cfg, ips); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	// Flags.
+
+	fleetCount  int
+	fleetBaseIP string
+	fleetWhite  bool
+)
+
+func init() {
+	fleetCmd.Flags().IntVarP(&fleetCount, "count", "n", 2,
+		"the number of bulbs")
+	fleetCmd.Flags().StringVar(&fleetBaseIP, "base-ip", "127.0.0.2",
+		"the address of the first bulb; the rest follow it")
+	fleetCmd.Flags().BoolVar(&fleetWhite, "white", false,
+		"emulate White 800 bulbs rather than Color 1000 bulbs")
+
+	RootCmd.AddCommand(fleetCmd)
+}
+
+// fleetIPs returns count consecutive IPv4 addresses starting at base.
+func fleetIPs(base string, count int) ([]net.IP, error) {
+	ip := net.ParseIP(base).To4()
+	if ip == nil {
+		return nil, errors.New("--base-ip must be an IPv4 address")
+	}
+	if count < 1 {
+		return nil, errors.New("--count must be at least 1")
+	}
+
+	ips := make([]net.IP, count)
+	for i := range ips {
+		ips[i] = append(net.IP(nil), ip...)
+
+		// Increment, carrying into the higher bytes.
+		for j := len(ip) - 1; j >= 0; j-- {
+			ip[j]++
+			if ip[j] != 0 {
+				break
+			}
+		}
+	}
+
+	return ips, nil
+}
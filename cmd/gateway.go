@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/bionicrm/emulifx/server"
+	"github.com/spf13/cobra"
+	"log"
+	"net"
+	"strconv"
+)
+
+var (
+	gatewayCmd = &cobra.Command{
+		Use:   "gateway",
+		Short: "emulates several headless bulbs behind a single socket",
+		Long: `Emulates several headless bulbs behind the socket at --addr, each with its
+own MAC address counting up from --mac. Messages are routed to a bulb by their
+target; broadcasts and untargeted messages reach every bulb. Unless set, --addr
+is :56700, where discovery broadcasts arrive.
+
+Unlike fleet, this needs no extra addresses, so thousands of bulbs can share
+one port, e.g. "emulifx gateway -n 1000".`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if gatewayCount < 1 {
+				log.Fatalln(errors.New("--count must be at least 1"))
+			}
+
+			defaultToLifxPort(cmd)
+
+			cfg, err := loadConfig(cmd, !gatewayWhite)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			ctx, stop := signalContext()
+			defer stop()
+
+			if err := server.StartGateway(ctx, cfg, gatewayCount); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	// Flags.
+
+	gatewayCount int
+	gatewayWhite bool
+)
+
+// defaultToLifxPort makes --addr default to LifxPort on every interface for
+// cmd, so broadcast discovery reaches its bulbs.
+func defaultToLifxPort(cmd *cobra.Command) {
+	if !cmd.Flags().Changed("addr") {
+		addr = net.JoinHostPort("", strconv.Itoa(server.LifxPort))
+	}
+}
+
+func init() {
+	gatewayCmd.Flags().IntVarP(&gatewayCount, "count", "n", 2,
+		"the number of bulbs")
+	gatewayCmd.Flags().BoolVar(&gatewayWhite, "white", false,
+		"emulate White 800 bulbs rather than Color 1000 bulbs")
+
+	RootCmd.AddCommand(gatewayCmd)
+}
@@ -1,6 +1,11 @@
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"github.com/bionicrm/emulifx/server"
+	"github.com/spf13/cobra"
+	"runtime"
+	"time"
+)
 
 var (
 	RootCmd = &cobra.Command{
@@ -10,10 +15,123 @@ var (
 
 	// Flags.
 
-	addr string
+	configPath  string
+	addr        string
+	mac         string
+	randomMAC   bool
+	metricsAddr string
+	controlAddr string
+	statePath   string
+	outages     []string
+	strict      bool
+	headless    bool
+	workers     int
+	trace       bool
+	profile     string
+	ambientLux  float64
+	day         time.Duration
+	dimmer      uint32
+	onboarding  bool
+	cloud       bool
+	cloudAddr   string
+	logUnknown  bool
+	canned      []string
+	bootTime    time.Duration
+	powerOn     string
+	clockSkew   time.Duration
+	rssi        float64
+	drift       bool
+	faults      server.Faults
+	throttle    server.Throttle
+
+	// Signal scripting.
+	signalPoints []string
+	signalWalk   float64
+	signalSpread float64
+	signalLoss   bool
 )
 
 func init() {
+	RootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "",
+		"a JSON file of server options; flags that are set take precedence")
 	RootCmd.PersistentFlags().StringVarP(&addr, "addr", "a", "127.0.0.1:0",
 		"the address to bind to for receiving messages from devices on the network")
+	RootCmd.PersistentFlags().StringVar(&mac, "mac", "",
+		"the device's MAC address, e.g. d0:73:d5:01:02:03")
+	RootCmd.PersistentFlags().BoolVar(&randomMAC, "random-mac", false,
+		"use a random LIFX MAC address, kept in the state file so it stays the same across runs")
+	RootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "",
+		"the address to serve Prometheus metrics on at /metrics, if set")
+	RootCmd.PersistentFlags().StringVar(&controlAddr, "control-addr", "",
+		"the address to serve the control API on, if set")
+	RootCmd.PersistentFlags().StringVar(&statePath, "state", "",
+		"the file to persist the device's state to across restarts and reboots")
+	RootCmd.PersistentFlags().StringArrayVar(&outages, "outage", nil,
+		"take the device offline, as [reboot@]AT[+FOR] after starting, e.g. 30s+10s or reboot@2m")
+	RootCmd.PersistentFlags().DurationVar(&bootTime, "boot-time", server.DefaultBootTime,
+		"how long the device stays silent while rebooting")
+	RootCmd.PersistentFlags().StringVar(&powerOn, "power-on", string(server.PowerOnLast),
+		"what the light does after rebooting: last to come on with the last color, restore to also keep its power, or white")
+	RootCmd.PersistentFlags().BoolVar(&strict, "strict", false,
+		"exit on the first malformed frame instead of logging and skipping it")
+	RootCmd.PersistentFlags().BoolVar(&headless, "headless", false,
+		"run without a window")
+	RootCmd.PersistentFlags().IntVar(&workers, "workers", runtime.NumCPU(),
+		"how many messages may be handled at once; each client is still answered in order")
+	RootCmd.PersistentFlags().BoolVar(&trace, "trace", false,
+		"log every message received, sent or dropped")
+	RootCmd.PersistentFlags().Float64Var(&rssi, "rssi", server.DefaultRSSI,
+		"the Wi-Fi signal strength in dBm, e.g. -40 for excellent or -80 for poor")
+	RootCmd.PersistentFlags().BoolVar(&drift, "drift", false,
+		"let the signal strength and MCU temperature drift like a real bulb's")
+	RootCmd.PersistentFlags().StringVar(&profile, "profile", string(server.ModernProfile),
+		"the firmware generation to emulate: modern, or legacy for the old tags messages")
+	RootCmd.PersistentFlags().Float64Var(&ambientLux, "lux", 300,
+		"what the ambient light sensor reads, or its reading at noon with --day")
+	RootCmd.PersistentFlags().DurationVar(&day, "day", 0,
+		"follow a day/night curve with days this long, e.g. 24h for the time of day here or 10m to test quickly")
+	RootCmd.PersistentFlags().Uint32Var(&dimmer, "dimmer-voltage", 0,
+		"what the dimmer sensor reads, in millivolts")
+	RootCmd.PersistentFlags().BoolVar(&onboarding, "unconfigured", false,
+		"start waiting to be onboarded onto one of the config file's AccessPoints, until the state file says it has been")
+	RootCmd.PersistentFlags().BoolVar(&cloud, "cloud-connected", false,
+		"report the device as connected to the LIFX cloud, or connect it to the stand-in one at --cloud-addr")
+	RootCmd.PersistentFlags().StringVar(&cloudAddr, "cloud-addr", "",
+		"serve a stand-in LIFX cloud over TLS on this address, which the device connects to while --cloud-connected")
+	RootCmd.PersistentFlags().BoolVar(&logUnknown, "log-unknown", false,
+		"log every message of an unknown type with its raw payload")
+	RootCmd.PersistentFlags().StringArrayVar(&canned, "canned", nil,
+		"answer a message type with a prepared response, as TYPE=RESPONSE[:HEX], e.g. 503=504:0a0b")
+	RootCmd.PersistentFlags().DurationVar(&clockSkew, "clock-skew", 0,
+		"how far ahead of this host the device's clock starts out, e.g. 90s or -1h")
+
+	// Fault injection.
+	RootCmd.PersistentFlags().Int64Var(&faults.Seed, "fault-seed", 0,
+		"the seed for fault injection, or 0 to pick one")
+	RootCmd.PersistentFlags().Float64Var(&faults.Drop, "fault-drop", 0,
+		"the probability of ignoring a message, and of not sending a response")
+	RootCmd.PersistentFlags().DurationVar(&faults.Delay, "fault-delay", 0,
+		"the delay added to every response")
+	RootCmd.PersistentFlags().DurationVar(&faults.Jitter, "fault-jitter", 0,
+		"the upper bound of a random delay added to every response")
+	RootCmd.PersistentFlags().Float64Var(&faults.Duplicate, "fault-duplicate", 0,
+		"the probability of sending a response twice")
+	RootCmd.PersistentFlags().Float64Var(&faults.Reorder, "fault-reorder", 0,
+		"the probability of holding a response back until the next one is sent")
+
+	// Signal scripting.
+	RootCmd.PersistentFlags().StringArrayVar(&signalPoints, "signal", nil,
+		"script the signal strength, as AT=RSSI after starting; e.g. 0s=-40 then 5m=-85 degrades it over five minutes")
+	RootCmd.PersistentFlags().Float64Var(&signalWalk, "signal-walk", 0,
+		"the dB the signal strength randomly walks by each second")
+	RootCmd.PersistentFlags().Float64Var(&signalSpread, "signal-spread", 0,
+		"the dB the random walk may stray from the script, 6 if unset")
+	RootCmd.PersistentFlags().BoolVar(&signalLoss, "signal-loss", false,
+		"lose messages when the signal is poor, more so the poorer it is")
+
+	// Throttling.
+	RootCmd.PersistentFlags().Float64Var(&throttle.Rate, "throttle-rate", 0,
+		"the messages per second the device processes, or 0 for no limit; real bulbs manage about 20")
+	RootCmd.PersistentFlags().IntVar(&throttle.Depth, "throttle-depth", 8,
+		"the messages that may queue while the device is busy before more are dropped")
 }
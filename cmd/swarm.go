@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"github.com/bionicrm/emulifx/server"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	swarmCmd = &cobra.Command{
+		Use:   "swarm",
+		Short: "load tests discovery with hundreds of headless bulbs",
+		Long: `Runs a gateway of lightweight headless bulbs, each taking its own time to
+respond, for load testing discovery code. When stopped, prints how many messages
+were received, how many of them were retries, and how many came from each
+client. Unless set, --addr is :56700, where discovery broadcasts arrive.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if swarm.Count < 1 {
+				log.Fatalln(errors.New("--count must be at least 1"))
+			}
+
+			defaultToLifxPort(cmd)
+
+			cfg, err := loadConfig(cmd, !swarmWhite)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			ctx, stop := signalContext()
+			defer stop()
+
+			if err := server.StartSwarm(ctx, cfg, swarm, os.Stdout); err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+
+	// Flags.
+
+	swarm      server.Swarm
+	swarmWhite bool
+)
+
+func init() {
+	swarmCmd.Flags().IntVarP(&swarm.Count, "count", "n", 500,
+		"the number of bulbs")
+	swarmCmd.Flags().DurationVar(&swarm.Latency, "latency", 30*time.Millisecond,
+		"the mean time a bulb takes to respond")
+	swarmCmd.Flags().DurationVar(&swarm.Spread, "spread", 15*time.Millisecond,
+		"the standard deviation of the bulbs' response times")
+	swarmCmd.Flags().BoolVar(&swarmWhite, "white", false,
+		"emulate White 800 bulbs rather than Color 1000 bulbs")
+
+	RootCmd.AddCommand(swarmCmd)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type (
+	// CannedResponse answers messages of type Type with a message of type
+	// Response carrying Payload, whatever the device would otherwise do. It
+	// is for reproducing traffic the protocol documentation doesn't cover.
+	//
+	// In flags it's written as "TYPE=RESPONSE[:HEX]", for example
+	// "503=504:0a0b".
+	CannedResponse struct {
+		Type     uint16
+		Response uint16
+		Payload  HexPayload
+	}
+
+	// HexPayload is a raw payload, written in config files as hex.
+	HexPayload []byte
+)
+
+func (o *CannedResponse) UnmarshalText(text []byte) error {
+	s := string(text)
+
+	*o = CannedResponse{}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("canned response %q: missing =RESPONSE", text)
+	}
+
+	t, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("canned response %q: %s", text, err)
+	}
+	o.Type = uint16(t)
+
+	parts = strings.SplitN(parts[1], ":", 2)
+	t, err = strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("canned response %q: %s", text, err)
+	}
+	o.Response = uint16(t)
+
+	if len(parts) == 2 {
+		if err := o.Payload.UnmarshalText([]byte(parts[1])); err != nil {
+			return fmt.Errorf("canned response %q: %s", text, err)
+		}
+	}
+
+	return nil
+}
+
+func (o *HexPayload) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*o = b
+
+	return nil
+}
+
+func (o HexPayload) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(o)), nil
+}
+
+func (o HexPayload) MarshalBinary() ([]byte, error) {
+	return o, nil
+}
+
+// canned returns the canned response to messages of type t, if there is one.
+func (o Config) canned(t uint16) (CannedResponse, bool) {
+	for _, c := range o.Canned {
+		if c.Type == t {
+			return c, true
+		}
+	}
+
+	return CannedResponse{}, false
+}
+
+// logUnknown logs a message whose type the device doesn't know, with its raw
+// payload.
+func (o *device) logUnknown(p packet) {
+	if o.cfg.LogUnknown {
+		o.log.Printf("unknown message type=%d source=%d seq=%d from=%s payload=%x", p.header.t, p.header.source, p.header.sequence, p.raddr, p.raw)
+	}
+}
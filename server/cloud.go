@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	wanStatusConnected    uint8 = 0
+	wanStatusDisconnected uint8 = 1
+
+	// DefaultCloudHost is where devices look for the cloud unless told
+	// otherwise.
+	DefaultCloudHost = "v2.broker.lifx.co"
+
+	// cloudRetry is how long a device waits before reconnecting to the
+	// cloud.
+	cloudRetry = 5 * time.Second
+)
+
+func (o *device) wanGet(w writer) error {
+	return w(true, wanStateType, wanStatePayload{
+		Status: o.wanStatus,
+	})
+}
+
+// wanConnectKey claims the device with the key given.
+func (o *device) wanConnectKey(payload *authKeyPayload, w writer) error {
+	o.wanAuthKey = payload.AuthKey
+
+	return w(false, wanStateConnectType, authKeyPayload{
+		AuthKey: o.wanAuthKey,
+	})
+}
+
+func (o *device) wanGetHost(w writer) error {
+	return w(true, wanStateHostType, wanHostPayload{
+		Host:               o.wanHost.host,
+		InsecureSkipVerify: o.wanHost.insecureSkipVerify,
+	})
+}
+
+func (o *device) wanSetHost(payload *wanHostPayload, w writer) error {
+	o.wanHost.host = payload.Host
+	o.wanHost.insecureSkipVerify = payload.InsecureSkipVerify
+
+	return w(false, wanStateHostType, *payload)
+}
+
+// setWanStatus records whether the device is connected to the cloud. It must
+// be called from update.
+func (o *device) setWanStatus(connected bool) {
+	status := wanStatusDisconnected
+	if connected {
+		status = wanStatusConnected
+	}
+	if status == o.wanStatus {
+		return
+	}
+
+	o.wanStatus = status
+	if connected {
+		o.log.Printf("connected to the cloud at %s", o.wanHost.host)
+	} else {
+		o.log.Println("disconnected from the cloud")
+	}
+}
+
+// setCloud connects the device to the cloud or disconnects it. A device
+// dialing a stand-in cloud hangs up, and stays disconnected until told to
+// connect again. It must be called from update.
+func (o *device) setCloud(connected bool) {
+	if o.cfg.CloudAddr == "" {
+		o.setWanStatus(connected)
+		return
+	}
+
+	o.cloud.wanted = connected
+	if !connected {
+		if o.cloud.hangUp != nil {
+			o.cloud.hangUp()
+		}
+		return
+	}
+
+	select {
+	case o.cloud.kick <- struct{}{}:
+	default:
+	}
+}
+
+// wantsCloud reports whether the device should be connected to its stand-in
+// cloud.
+func (o *device) wantsCloud() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.cloud.wanted
+}
+
+// dialCloud keeps the device connected to the cloud at its WAN host while it
+// wants to be, until ctx is done.
+func (o *device) dialCloud(ctx context.Context) {
+	for {
+		if !o.wantsCloud() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.cloud.kick:
+			}
+			continue
+		}
+
+		call, hangUp := context.WithCancel(ctx)
+		o.post(func() {
+			o.cloud.hangUp = hangUp
+
+			// Told to disconnect while dialing.
+			if !o.cloud.wanted {
+				hangUp()
+			}
+		})
+
+		s := o.snapshot()
+		err := o.connectCloud(call, s.wanHost.host, s.wanHost.insecureSkipVerify, s.wanAuthKey)
+		hangUp()
+
+		o.post(func() {
+			o.cloud.hangUp = nil
+			o.setWanStatus(false)
+		})
+		if err != nil && call.Err() == nil {
+			o.log.Println(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.cloud.kick:
+		case <-o.clk.After(cloudRetry):
+		}
+	}
+}
+
+// connectCloud connects to the cloud at host and stays connected until either
+// end hangs up.
+func (o *device) connectCloud(ctx context.Context, host string, insecureSkipVerify bool, key [32]byte) error {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://"+host+"/connect", nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Device", formatMAC(o.mac))
+	if key != [32]byte{} {
+		req.Header.Set("Authorization", "Bearer "+hex.EncodeToString(key[:]))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &cloudError{resp.Status}
+	}
+
+	o.post(func() {
+		o.setWanStatus(true)
+	})
+
+	// The cloud holds the connection open for as long as it is up.
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+
+	return err
+}
+
+type cloudError struct {
+	status string
+}
+
+func (o *cloudError) Error() string {
+	return "cloud refused connection: " + o.status
+}
+
+// serveCloud serves a stand-in for the LIFX cloud over TLS on addr, with a
+// throwaway self-signed certificate. Devices connect to it and stay
+// connected until it shuts down.
+func serveCloud(addr string) (*http.Server, error) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	shutdown := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		device := r.Header.Get("X-Device")
+		claimed := r.Header.Get("Authorization") != ""
+		log.Printf("cloud: %s connected, claimed: %t", device, claimed)
+
+		w.WriteHeader(http.StatusOK)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+		case <-shutdown:
+		}
+		log.Printf("cloud: %s disconnected", device)
+	})
+
+	srv := &http.Server{Handler: mux}
+	srv.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	go func() {
+		tl := tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err := srv.Serve(tl); err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	return srv, nil
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "emulifx cloud"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
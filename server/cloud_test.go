@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCloudDisconnectRedials(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv, err := serveCloud(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdownServers([]*http.Server{srv})
+
+	dev, clk := newTestDevice(t, Config{CloudAddr: addr, CloudConnected: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.start(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	status := func(want uint8) func() bool {
+		return func() bool {
+			return dev.snapshot().wanStatus == want
+		}
+	}
+	retry := func() {
+		clk.Advance(cloudRetry)
+	}
+
+	waitFor(t, "the device to connect", status(wanStatusConnected), nil)
+
+	dev.post(func() {
+		dev.setCloud(false)
+	})
+	waitFor(t, "the device to hang up", status(wanStatusDisconnected), nil)
+
+	// It doesn't redial on its own.
+	for i := 0; i < 3; i++ {
+		retry()
+		time.Sleep(10 * time.Millisecond)
+		if status(wanStatusConnected)() {
+			t.Fatal("the device redialed while told to stay disconnected")
+		}
+	}
+
+	dev.post(func() {
+		dev.setCloud(true)
+	})
+	waitFor(t, "the device to reconnect", status(wanStatusConnected), nil)
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/lifx-tools/implifx.v1"
+	"log"
+	"net"
+	"sync"
+)
+
+const (
+	headerSize = 36
+	protocol   = 1024
+
+	maxFrameSize = 1024
+)
+
+type (
+	// conn is a UDP socket speaking the LIFX LAN protocol. Unlike
+	// implifx.Connection it keeps hold of every raw datagram, so frames that
+	// fail to decode can be reported and skipped instead of ending the
+	// receive loop. Any number of devices may answer through it.
+	conn struct {
+		*net.UDPConn
+		faults *injector
+		buf    [maxFrameSize]byte
+	}
+
+	// header is the decoded 36 byte LIFX header. The fields needed to address
+	// a response are kept here rather than read back out of the
+	// controlifx.LanHeader.
+	header struct {
+		size        uint16
+		tagged      bool
+		addressable bool
+		protocol    uint16
+		source      uint32
+		target      uint64
+		ackRequired bool
+		resRequired bool
+		sequence    uint8
+		t           uint16
+	}
+
+	// packet is a received message. Types known to implifx are decoded into
+	// msg, and those in payloads into payload. Unknown types keep their raw
+	// payload in raw.
+	packet struct {
+		n       int
+		raddr   *net.UDPAddr
+		header  header
+		msg     implifx.ReceivableLanMessage
+		payload encoding.BinaryUnmarshaler
+		raw     []byte
+	}
+
+	// FrameError describes a datagram that could not be decoded as a LIFX
+	// message.
+	FrameError struct {
+		Reason string
+		Data   []byte
+		Err    error
+	}
+
+	// diagnostics counts malformed frames by reason.
+	diagnostics struct {
+		mu        sync.Mutex
+		malformed map[string]uint64
+	}
+)
+
+const (
+	badSize     = "size"
+	badProtocol = "protocol"
+	badPayload  = "payload"
+)
+
+var diag = diagnostics{
+	malformed: make(map[string]uint64),
+}
+
+func (o *FrameError) Error() string {
+	if o.Err != nil {
+		return fmt.Sprintf("malformed frame (%s): %s", o.Reason, o.Err)
+	}
+
+	return fmt.Sprintf("malformed frame (%s)", o.Reason)
+}
+
+// listen binds a socket to addr. A shared socket may bind a port that other
+// shared sockets are bound to on other addresses.
+func listen(addr string, shared bool) (*conn, error) {
+	var lc net.ListenConfig
+	if shared {
+		lc.Control = reuseAddr
+	}
+
+	pc, err := lc.ListenPacket(context.Background(), "udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{UDPConn: pc.(*net.UDPConn)}, nil
+}
+
+func (o *conn) port() uint16 {
+	return uint16(o.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// receive reads the next datagram. A *FrameError is returned for datagrams
+// that are not valid LIFX messages; the socket remains usable afterwards.
+func (o *conn) receive() (p packet, err error) {
+	p.n, p.raddr, err = o.ReadFromUDP(o.buf[:])
+	if err != nil {
+		return
+	}
+
+	data := o.buf[:p.n]
+
+	if err = p.header.UnmarshalBinary(data); err != nil {
+		return
+	}
+	if int(p.header.size) != p.n {
+		return p, newFrameError(badSize, data, fmt.Errorf("header says %d bytes, got %d", p.header.size, p.n))
+	}
+	if p.header.protocol != protocol {
+		return p, newFrameError(badProtocol, data, fmt.Errorf("got %d", p.header.protocol))
+	}
+
+	var local bool
+	if p.payload, local, err = decodePayload(p.header.t, data[headerSize:]); err != nil {
+		return p, newFrameError(badPayload, data, err)
+	}
+	if local {
+		return
+	}
+	if !knownType(p.header.t) {
+		// The receive buffer is reused.
+		p.raw = append([]byte(nil), data[headerSize:]...)
+		return
+	}
+
+	if err = p.msg.UnmarshalBinary(data); err != nil {
+		return p, newFrameError(badPayload, data, err)
+	}
+
+	return
+}
+
+// respond sends a message of type t from the device with address mac back to
+// the sender of p. Unless always is set, the response is only sent when the
+// sender asked for one.
+func (o *conn) respond(always bool, p packet, mac uint64, t uint16, payload encoding.BinaryMarshaler) (int, error) {
+	if !always && !p.header.resRequired {
+		return 0, nil
+	}
+
+	return o.send(p, mac, t, payload)
+}
+
+func (o *conn) send(p packet, mac uint64, t uint16, payload encoding.BinaryMarshaler) (int, error) {
+	var b []byte
+
+	if payload != nil {
+		var err error
+		if b, err = payload.MarshalBinary(); err != nil {
+			return 0, err
+		}
+	}
+
+	h := header{
+		size:        uint16(headerSize + len(b)),
+		addressable: true,
+		protocol:    protocol,
+		source:      p.header.source,
+		target:      mac,
+		sequence:    p.header.sequence,
+		t:           t,
+	}
+
+	data, err := h.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	d := datagram{
+		t:     t,
+		mac:   mac,
+		data:  append(data, b...),
+		raddr: p.raddr,
+	}
+
+	if o.faults == nil {
+		return o.write(d)
+	}
+
+	o.faults.send(d, func(d datagram) {
+		if _, err := o.write(d); err != nil {
+			log.Println(err)
+		}
+	})
+
+	return len(d.data), nil
+}
+
+func (o *conn) write(d datagram) (int, error) {
+	n, err := o.WriteToUDP(d.data, d.raddr)
+	metrics.send(d.mac, d.t, n)
+	traceSend(d.t, n, d.raddr)
+
+	return n, err
+}
+
+func (o *header) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize {
+		return newFrameError(badSize, data, fmt.Errorf("%d bytes is shorter than a header", len(data)))
+	}
+
+	o.size = binary.LittleEndian.Uint16(data[0:])
+
+	flags := binary.LittleEndian.Uint16(data[2:])
+	o.protocol = flags & 0xfff
+	o.addressable = flags&(1<<12) != 0
+	o.tagged = flags&(1<<13) != 0
+
+	o.source = binary.LittleEndian.Uint32(data[4:])
+
+	// The target is a MAC address in network order, padded to 8 bytes.
+	o.target = 0
+	for i := 0; i < 6; i++ {
+		o.target = o.target<<8 | uint64(data[8+i])
+	}
+
+	o.resRequired = data[22]&1 != 0
+	o.ackRequired = data[22]&2 != 0
+	o.sequence = data[23]
+	o.t = binary.LittleEndian.Uint16(data[32:])
+
+	return nil
+}
+
+func (o header) MarshalBinary() ([]byte, error) {
+	data := make([]byte, headerSize)
+
+	binary.LittleEndian.PutUint16(data[0:], o.size)
+
+	flags := o.protocol & 0xfff
+	if o.addressable {
+		flags |= 1 << 12
+	}
+	if o.tagged {
+		flags |= 1 << 13
+	}
+	binary.LittleEndian.PutUint16(data[2:], flags)
+
+	binary.LittleEndian.PutUint32(data[4:], o.source)
+
+	for i := 0; i < 6; i++ {
+		data[8+i] = byte(o.target >> uint(40-8*i))
+	}
+
+	if o.resRequired {
+		data[22] |= 1
+	}
+	if o.ackRequired {
+		data[22] |= 2
+	}
+	data[23] = o.sequence
+	binary.LittleEndian.PutUint16(data[32:], o.t)
+
+	return data, nil
+}
+
+func newFrameError(reason string, data []byte, err error) *FrameError {
+	// The receive buffer is reused, so keep a copy for the report.
+	b := make([]byte, len(data))
+	copy(b, data)
+
+	return &FrameError{
+		Reason: reason,
+		Data:   b,
+		Err:    err,
+	}
+}
+
+// report logs a malformed frame with a hex dump of its contents and counts it.
+func (o *diagnostics) report(raddr *net.UDPAddr, err *FrameError) {
+	o.mu.Lock()
+	o.malformed[err.Reason]++
+	count := o.malformed[err.Reason]
+	o.mu.Unlock()
+
+	log.Printf("%s from %s (%d so far):\n%s", err, raddr, count, hex.Dump(err.Data))
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// serveControl serves the control API, which lets test harnesses act on
+// devices out of band:
+//
+//	POST /offline?for=10s  takes the device off the network
+//	POST /reboot?for=2s    power cycles the device; "for" is the boot time,
+//	                       the configured one if unset
+//	POST /reset?for=1s     holds the reset switch down, then restores factory
+//	                       defaults
+//	POST /sensors?lux=250  sets the ambient light; "auto" goes back to the
+//	                       configured reading, and "dimmer" sets the dimmer
+//	                       voltage in millivolts
+//	POST /cloud?connected=false
+//	                       connects the device to the cloud or disconnects
+//	                       it, until told otherwise
+//
+// Requests apply to every device unless a "mac" parameter picks one.
+func serveControl(addr string, devs []*device) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/offline", outageHandler(devs, false))
+	mux.HandleFunc("/reboot", outageHandler(devs, true))
+	mux.HandleFunc("/reset", resetHandler(devs))
+	mux.HandleFunc("/sensors", sensorsHandler(devs))
+	mux.HandleFunc("/cloud", cloudHandler(devs))
+
+	return serveHTTP(addr, mux)
+}
+
+// selectDevices returns the devices the request r applies to.
+func selectDevices(w http.ResponseWriter, r *http.Request, devs []*device) ([]*device, bool) {
+	s := r.FormValue("mac")
+	if s == "" {
+		return devs, true
+	}
+
+	mac, err := ParseMAC(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	for _, dev := range devs {
+		if dev.snapshot().mac == mac {
+			return []*device{dev}, true
+		}
+	}
+
+	http.Error(w, "no device with MAC "+s, http.StatusNotFound)
+	return nil, false
+}
+
+func outageHandler(devs []*device, reboot bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var d time.Duration
+		if s := r.FormValue("for"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else if !reboot {
+			http.Error(w, "missing for", http.StatusBadRequest)
+			return
+		}
+
+		devs, ok := selectDevices(w, r, devs)
+		if !ok {
+			return
+		}
+
+		for _, dev := range devs {
+			dev := dev
+			dev.post(func() {
+				if d == 0 {
+					dev.goOffline(dev.cfg.bootTime(), reboot)
+				} else {
+					dev.goOffline(d, reboot)
+				}
+			})
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func resetHandler(devs []*device) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var d time.Duration
+		if s := r.FormValue("for"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		devs, ok := selectDevices(w, r, devs)
+		if !ok {
+			return
+		}
+
+		for _, dev := range devs {
+			dev := dev
+			dev.post(func() {
+				dev.pressResetSwitch(d)
+			})
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func sensorsHandler(devs []*device) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var (
+			lux    = math.NaN()
+			dimmer = -1
+		)
+		switch s := r.FormValue("lux"); s {
+		case "":
+		case "auto":
+			lux = -1
+		default:
+			var err error
+			if lux, err = strconv.ParseFloat(s, 64); err != nil || lux < 0 {
+				http.Error(w, "lux must be a non-negative number or auto", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.FormValue("dimmer"); s != "" {
+			v, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			dimmer = int(v)
+		}
+
+		devs, ok := selectDevices(w, r, devs)
+		if !ok {
+			return
+		}
+
+		for _, dev := range devs {
+			dev := dev
+			dev.post(func() {
+				if !math.IsNaN(lux) {
+					dev.setAmbientLux(lux)
+				}
+				if dimmer >= 0 {
+					dev.sensorDimmerVoltage = uint32(dimmer)
+				}
+			})
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func cloudHandler(devs []*device) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		connected, err := strconv.ParseBool(r.FormValue("connected"))
+		if err != nil {
+			http.Error(w, "connected must be true or false", http.StatusBadRequest)
+			return
+		}
+
+		devs, ok := selectDevices(w, r, devs)
+		if !ok {
+			return
+		}
+
+		for _, dev := range devs {
+			dev := dev
+			dev.post(func() {
+				dev.setCloud(connected)
+			})
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
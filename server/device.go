@@ -0,0 +1,524 @@
+package server
+
+import (
+	"context"
+	"encoding"
+	"github.com/bionicrm/emulifx/bus"
+	"github.com/bionicrm/emulifx/clock"
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// workerQueueSize is how many messages may wait for each worker.
+const workerQueueSize = 64
+
+type (
+	deviceState struct {
+		service             int8
+		port                uint16
+		time                int64
+		resetSwitchPosition uint8
+		dummyLoadOn         bool
+		hostInfo            struct {
+			signal         float32
+			tx             uint32
+			rx             uint32
+			mcuTemperature int16
+		}
+		hostFirmware struct {
+			build   int64
+			install int64
+			version uint32
+		}
+		wifiInfo struct {
+			signal         float32
+			tx             uint32
+			rx             uint32
+			mcuTemperature int16
+		}
+		wifiFirmware struct {
+			build   int64
+			install int64
+			version uint32
+		}
+		powerLevel uint16
+		label      string
+		tags       struct {
+			tags   uint64
+			labels [64]string
+		}
+		version struct {
+			vendor  uint32
+			product uint32
+			version uint32
+		}
+		info struct {
+			time     int64
+			uptime   int64
+			downtime int64
+		}
+		mcuRailVoltage  uint32
+		factoryTestMode struct {
+			on       bool
+			disabled bool
+		}
+		site     [6]byte
+		location struct {
+			location  [16]byte
+			label     string
+			updatedAt int64
+		}
+		group struct {
+			group     [16]byte
+			label     string
+			updatedAt int64
+		}
+		owner struct {
+			owner     [16]byte
+			label     string
+			updatedAt int64
+		}
+		state struct {
+			color controlifx.HSBK
+			dim   int16
+			label string
+			tags  uint64
+		}
+		lightRailVoltage  uint32
+		lightTemperature  int16
+		lightSimpleEvents []struct {
+			time     int64
+			power    uint16
+			duration uint32
+			waveform int8
+			max      uint16
+		}
+		wanStatus  uint8
+		wanAuthKey [32]byte
+		wanHost    struct {
+			host               string
+			insecureSkipVerify bool
+		}
+		wifi struct {
+			networkInterface int8
+			status           uint8
+		}
+		wifiAccessPoints struct {
+			networkInterface int8
+			ssid             string
+			security         int8
+			strength         int16
+			channel          uint16
+		}
+		wifiAccessPoint struct {
+			networkInterface int8
+			ssid             string
+			pass             string
+			security         int8
+		}
+		sensorAmbientLightLux float32
+		sensorDimmerVoltage   uint32
+
+		// Extra.
+		startTime int64
+		mac       uint64
+
+		// unconfigured is set until the device has joined a network, and
+		// only onboarding messages are answered until then.
+		unconfigured bool
+	}
+
+	// device is an emulated bulb. Its state is only changed through update,
+	// which holds mu, so other goroutines can read consistent snapshots.
+	// Messages that only read the state are handled with mu read locked.
+	device struct {
+		mu sync.RWMutex
+		deviceState
+
+		// readings guards what reads still update: the sensors, the
+		// traffic counters in hostInfo and wifiInfo, and the readings
+		// derived from the sensors. These may be changed with mu locked,
+		// or with mu read locked and readings held.
+		readings sync.Mutex
+
+		// bus publishes changes to the light to the window and anything
+		// else listening.
+		bus *bus.Bus
+
+		cfg  Config
+		clk  clock.Clock
+		conn *conn
+		log  *log.Logger
+
+		// latency holds back every response, for devices slower than the
+		// host they run on.
+		latency time.Duration
+
+		// packets queues received messages for the receive loop.
+		packets chan packet
+
+		// events carries work from timers and the control API to the
+		// receive loop, until done is closed.
+		events chan func()
+		done   chan struct{}
+
+		// power is a fade to powerLevel from from, starting at start and
+		// lasting duration, in Unix nanoseconds.
+		power struct {
+			from     uint16
+			start    int64
+			duration int64
+		}
+
+		outage struct {
+			// until is when the device comes back, in Unix nanoseconds.
+			until int64
+
+			// generation is bumped by every outage, so that only the
+			// latest one brings the device back.
+			generation int
+		}
+
+		// sensors holds what the signal strength and temperature readings
+		// are derived from.
+		sensors struct {
+			rand        *rand.Rand
+			rssi        float64
+			temperature float64
+
+			// walk is how far the signal has wandered from its script.
+			walk float64
+
+			// luxSet overrides the configured ambient light.
+			luxSet bool
+
+			// since is when the device was first started and at is when
+			// the readings were last sampled, in Unix nanoseconds.
+			since int64
+			at    int64
+		}
+
+		// cloud tracks the connection to a stand-in cloud.
+		cloud struct {
+			// wanted is whether the device should be connected, and
+			// kick wakes dialCloud when it becomes so.
+			wanted bool
+			kick   chan struct{}
+
+			// hangUp drops the current connection, if there is one.
+			hangUp context.CancelFunc
+		}
+
+		persisted struct {
+			// path is the state file, or empty to keep the state in
+			// memory only.
+			path  string
+			state persistedState
+		}
+	}
+)
+
+func newDevice(cfg Config, conn *conn) *device {
+	cfg.Signal = cfg.Signal.sorted()
+
+	o := &device{
+		cfg:    cfg,
+		clk:    cfg.clock(),
+		conn:   conn,
+		log:    log.New(log.Writer(), "", log.Flags()),
+		events: make(chan func()),
+		done:   make(chan struct{}),
+		bus:    bus.New(),
+
+		// A throttled device queues messages while it is busy, rather
+		// than holding up the socket.
+		packets: make(chan packet, cfg.Throttle.Depth),
+	}
+	o.cloud.kick = make(chan struct{}, 1)
+	o.configure(conn.port(), cfg.HasColor)
+
+	return o
+}
+
+// snapshot returns a copy of the device's current state.
+func (o *device) snapshot() deviceState {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	o.readings.Lock()
+	defer o.readings.Unlock()
+
+	return o.deviceState
+}
+
+// post queues f to run on the receive loop. It is dropped if the loop has
+// stopped.
+func (o *device) post(f func()) {
+	select {
+	case o.events <- f:
+	case <-o.done:
+	}
+}
+
+// start receives messages on the device's socket and handles them until ctx
+// is done or the socket fails.
+func (o *device) start(ctx context.Context) error {
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- receive(o.conn, o.cfg.Strict, o.enqueue)
+	}()
+
+	return o.run(ctx, errCh)
+}
+
+// enqueue queues p for the receive loop, unless the network or a busy device
+// loses it first.
+func (o *device) enqueue(p packet) {
+	if o.conn.faults.dropReceive() {
+		drop(p, dropFault)
+		return
+	}
+
+	// The radio hears everything that makes it through the air, even if
+	// the MCU never gets to it.
+	o.mu.RLock()
+	o.readings.Lock()
+	lost := o.lostToSignal()
+	if !lost {
+		o.wifiInfo.rx += uint32(p.n)
+	}
+	o.readings.Unlock()
+	o.mu.RUnlock()
+
+	if lost {
+		drop(p, dropSignal)
+		return
+	}
+
+	if !o.cfg.Throttle.enabled() {
+		// Nothing takes packets once the device has stopped.
+		select {
+		case o.packets <- p:
+		case <-o.done:
+		}
+		return
+	}
+
+	select {
+	case o.packets <- p:
+	default:
+		drop(p, dropThrottle)
+	}
+}
+
+// run handles messages from packets and events until errCh yields an error
+// or ctx is done. The state is flushed before it returns.
+//
+// Messages are spread over a pool of workers by their source, so each client
+// is answered in order. Messages from different clients that only read the
+// state are handled in parallel; changes are applied one at a time.
+//
+// A throttled device handles one message at a time, and rests for the
+// throttle's cost after each.
+func (o *device) run(ctx context.Context, errCh <-chan error) error {
+	defer func() {
+		close(o.done)
+
+		o.mu.Lock()
+		o.saveState()
+		o.mu.Unlock()
+	}()
+
+	workers := make([]chan packet, o.cfg.Workers)
+	if len(workers) == 0 {
+		workers = make([]chan packet, 1)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		throttled = o.cfg.Throttle.enabled()
+		processed = make(chan struct{}, 1)
+	)
+	for i := range workers {
+		workers[i] = make(chan packet, workerQueueSize)
+
+		wg.Add(1)
+		go func(queue <-chan packet) {
+			defer wg.Done()
+
+			for p := range queue {
+				o.serve(p)
+
+				if throttled {
+					processed <- struct{}{}
+				}
+			}
+		}(workers[i])
+	}
+	defer func() {
+		for _, queue := range workers {
+			close(queue)
+		}
+		wg.Wait()
+	}()
+
+	sub := o.bus.Subscribe(1)
+	go metrics.watch(o.mac, sub)
+	defer o.bus.Unsubscribe(sub)
+
+	o.scheduleOutages(o.cfg.Outages)
+
+	if o.cfg.CloudAddr != "" {
+		go o.dialCloud(ctx)
+	}
+
+	var (
+		in    <-chan packet = o.packets
+		ready <-chan time.Time
+	)
+
+	for {
+		select {
+		case p := <-in:
+			workers[p.header.source%uint32(len(workers))] <- p
+
+			if throttled {
+				// Busy until the message has been processed.
+				in = nil
+			}
+		case <-processed:
+			ready = o.clk.After(o.cfg.Throttle.cost())
+		case <-ready:
+			in, ready = o.packets, nil
+		case f := <-o.events:
+			o.update(f)
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// update runs f with the device locked, then persists the state.
+func (o *device) update(f func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f()
+	o.saveState()
+}
+
+// notify publishes the light's state after a change that takes duration
+// milliseconds. It must be called from update, which keeps changes in order.
+func (o *device) notify(duration uint32) {
+	o.bus.Publish(bus.Light{
+		PowerLevel: o.powerLevel,
+		Color:      o.state.color,
+		Duration:   duration,
+	})
+}
+
+// serve handles p. Responses are collected while the device is locked and
+// only sent once it is released. Messages in readTypes only read lock it.
+func (o *device) serve(p packet) {
+	type response struct {
+		always  bool
+		t       uint16
+		payload encoding.BinaryMarshaler
+	}
+
+	var (
+		responses []response
+		dropped   bool
+		accepted  bool
+	)
+
+	process := func() {
+		if o.offline() {
+			dropped = true
+			return
+		}
+
+		o.readings.Lock()
+		o.hostInfo.rx += uint32(p.n)
+		o.readings.Unlock()
+		metrics.receive(o.mac, p.header, p.n)
+
+		var err error
+		if accepted, err = o.handle(p, func(always bool, t uint16, payload encoding.BinaryMarshaler) error {
+			responses = append(responses, response{always, t, payload})
+			return nil
+		}); err != nil {
+			metrics.handlerError()
+			o.log.Println(err)
+		}
+	}
+
+	if readTypes[p.header.t] {
+		o.mu.RLock()
+		process()
+		o.mu.RUnlock()
+	} else {
+		o.update(process)
+	}
+
+	if dropped {
+		drop(p, dropOffline)
+		return
+	}
+	if !accepted {
+		return
+	}
+
+	send := func() {
+		o.mu.RLock()
+		o.readings.Lock()
+		lost := o.lostToSignal()
+		o.readings.Unlock()
+		o.mu.RUnlock()
+
+		if lost {
+			return
+		}
+
+		var tx int
+
+		// Acknowledge once, ahead of however many responses there are.
+		if p.header.ackRequired {
+			n, err := o.conn.send(p, o.mac, controlifx.AcknowledgementType, nil)
+			tx += n
+
+			if err != nil {
+				metrics.handlerError()
+				o.log.Println(err)
+			}
+		}
+
+		for _, r := range responses {
+			n, err := o.conn.respond(r.always, p, o.mac, r.t, r.payload)
+			tx += n
+
+			if err != nil {
+				metrics.handlerError()
+				o.log.Println(err)
+			}
+		}
+
+		o.mu.RLock()
+		o.readings.Lock()
+		o.hostInfo.tx += uint32(tx)
+		o.wifiInfo.tx += uint32(tx)
+		o.readings.Unlock()
+		o.mu.RUnlock()
+	}
+
+	if o.latency > 0 {
+		o.clk.AfterFunc(o.latency, send)
+	} else {
+		send()
+	}
+}
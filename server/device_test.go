@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"net"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	// controllers is how many clients talk to a device at once in
+	// benchmarks.
+	controllers = 256
+
+	// retryTimeout is how long a client waits for a response before
+	// sending its message again.
+	retryTimeout = 100 * time.Millisecond
+)
+
+// benchmarkServe has controllers clients each send messages of type t to a
+// running device, one at a time, until b.N have been answered.
+func benchmarkServe(b *testing.B, t uint16) {
+	dev, _ := newTestDevice(b, Config{Workers: runtime.NumCPU()})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.start(ctx)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			b.Error(err)
+		}
+	}()
+
+	clients := make([]*net.UDPConn, controllers)
+	for i := range clients {
+		c, err := net.DialUDP("udp4", nil, dev.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Close()
+
+		clients[i] = c
+	}
+
+	var (
+		wg   sync.WaitGroup
+		sent int64
+	)
+
+	b.ResetTimer()
+
+	for i, c := range clients {
+		wg.Add(1)
+		go func(source uint32, c *net.UDPConn) {
+			defer wg.Done()
+
+			buf := make([]byte, maxFrameSize)
+			for seq := uint8(0); atomic.AddInt64(&sent, 1) <= int64(b.N); seq++ {
+				data, err := header{
+					size:        headerSize,
+					tagged:      true,
+					addressable: true,
+					protocol:    protocol,
+					source:      source,
+					resRequired: true,
+					sequence:    seq,
+					t:           t,
+				}.MarshalBinary()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+
+				for {
+					if _, err := c.Write(data); err != nil {
+						b.Error(err)
+						return
+					}
+
+					c.SetReadDeadline(time.Now().Add(retryTimeout))
+					_, err := c.Read(buf)
+					if err == nil {
+						break
+					}
+					if err, ok := err.(net.Error); !ok || !err.Timeout() {
+						b.Error(err)
+						return
+					}
+
+					// Lost with so much in flight, so ask again like
+					// a real controller would.
+				}
+			}
+		}(uint32(i+1), c)
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkServeGetService(b *testing.B) {
+	benchmarkServe(b, controlifx.GetServiceType)
+}
+
+func BenchmarkServeLightGet(b *testing.B) {
+	benchmarkServe(b, controlifx.LightGetType)
+}
+
+// exchange serves a message with header h from a loopback client, and returns
+// the types of the messages sent back.
+func exchange(t *testing.T, dev *device, h header) []uint16 {
+	t.Helper()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	h.size = headerSize
+	h.protocol = protocol
+	dev.serve(packet{
+		n:      headerSize,
+		raddr:  client.LocalAddr().(*net.UDPAddr),
+		header: h,
+	})
+
+	var types []uint16
+	buf := make([]byte, maxFrameSize)
+	for {
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := client.Read(buf)
+		if err != nil {
+			return types
+		}
+		types = append(types, binary.LittleEndian.Uint16(buf[32:n]))
+	}
+}
+
+func TestServeAcksOnce(t *testing.T) {
+	dev, _ := newTestDevice(t, Config{})
+
+	got := exchange(t, dev, header{
+		source:      1,
+		ackRequired: true,
+		resRequired: true,
+		t:           wifiGetAccessPointsType,
+	})
+
+	want := []uint16{controlifx.AcknowledgementType}
+	for range DefaultAccessPoints {
+		want = append(want, wifiStateAccessPointType)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent types %v, want %v", got, want)
+	}
+}
+
+func TestServeIgnoredNotAcked(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		cfg  Config
+		t    uint16
+	}{
+		{"legacy message on a modern profile", Config{Profile: ModernProfile}, getTagsType},
+		{"light message while unconfigured", Config{Unconfigured: true}, controlifx.LightGetType},
+	} {
+		dev, _ := newTestDevice(t, test.cfg)
+
+		got := exchange(t, dev, header{
+			source:      1,
+			ackRequired: true,
+			resRequired: true,
+			t:           test.t,
+		})
+		if len(got) != 0 {
+			t.Errorf("%s: sent types %v, want none", test.name, got)
+		}
+	}
+}
+
+func TestEnqueueAfterStop(t *testing.T) {
+	dev, _ := newTestDevice(t, Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := dev.run(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	enqueued := make(chan struct{})
+	go func() {
+		for i := 0; i < 2; i++ {
+			dev.enqueue(packet{n: headerSize})
+		}
+		close(enqueued)
+	}()
+
+	select {
+	case <-enqueued:
+	case <-time.After(time.Second):
+		t.Fatal("enqueue blocked on a stopped device")
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"time"
+)
+
+const (
+	resetSwitchUp   uint8 = 0
+	resetSwitchDown uint8 = 1
+
+	// Rail voltages in millivolts. The light rail sags under load, which
+	// the dummy load puts at full.
+	mcuRailVoltage   = 3300
+	lightRailVoltage = 24000
+	lightRailSag     = 600
+)
+
+func (o *device) getResetSwitch(w writer) error {
+	return w(true, stateResetSwitchType, resetSwitchPayload{
+		Position: o.resetSwitchPosition,
+	})
+}
+
+func (o *device) getDummyLoad(w writer) error {
+	return w(true, stateDummyLoadType, onPayload{
+		On: o.dummyLoadOn,
+	})
+}
+
+func (o *device) setDummyLoad(payload *onPayload, w writer) error {
+	o.dummyLoadOn = payload.On
+
+	return w(false, stateDummyLoadType, onPayload{
+		On: o.dummyLoadOn,
+	})
+}
+
+func (o *device) getMcuRailVoltage(w writer) error {
+	return w(true, stateMcuRailVoltageType, voltagePayload{
+		Voltage: o.mcuRailVoltage,
+	})
+}
+
+func (o *device) setFactoryTestMode(payload *onPayload, w writer) error {
+	// Once disabled, test mode stays off for good.
+	if !o.factoryTestMode.disabled {
+		o.factoryTestMode.on = payload.On
+	}
+
+	return w(false, stateFactoryTestModeType, onPayload{
+		On: o.factoryTestMode.on,
+	})
+}
+
+func (o *device) disableFactoryTestMode(w writer) error {
+	o.factoryTestMode.on = false
+	o.factoryTestMode.disabled = true
+
+	return w(false, stateFactoryTestModeType, onPayload{
+		On: o.factoryTestMode.on,
+	})
+}
+
+func (o *device) lightGetRailVoltage(w writer) error {
+	load := 1.0
+	if !o.dummyLoadOn {
+		load = o.load()
+	}
+	o.readings.Lock()
+	o.lightRailVoltage = uint32(lightRailVoltage - load*lightRailSag)
+	voltage := o.lightRailVoltage
+	o.readings.Unlock()
+
+	return w(true, lightStateRailVoltageType, voltagePayload{
+		Voltage: voltage,
+	})
+}
+
+// pressResetSwitch holds the reset switch down for d. Letting go of it wipes
+// the device back to factory defaults and reboots it. It must be called from
+// update.
+func (o *device) pressResetSwitch(d time.Duration) {
+	o.log.Println("reset switch pressed")
+	o.resetSwitchPosition = resetSwitchDown
+
+	o.clk.AfterFunc(d, func() {
+		o.post(func() {
+			o.resetSwitchPosition = resetSwitchUp
+			o.factoryReset()
+		})
+	})
+}
+
+// factoryReset forgets everything the device has been told and reboots it.
+// It must be called from update.
+func (o *device) factoryReset() {
+	o.log.Println("restoring factory defaults")
+
+	o.label = ""
+	o.powerLevel = 0
+	o.state.color = controlifx.HSBK{Kelvin: 3500}
+	o.location.location, o.location.label, o.location.updatedAt = [16]byte{}, "", 0
+	o.group.group, o.group.label, o.group.updatedAt = [16]byte{}, "", 0
+	o.owner.owner, o.owner.label, o.owner.updatedAt = [16]byte{}, "", 0
+	o.tags.tags = 0
+	o.tags.labels = [64]string{}
+	o.state.tags = 0
+	o.wanAuthKey = [32]byte{}
+	o.dummyLoadOn = false
+	o.factoryTestMode.on = false
+	o.factoryTestMode.disabled = false
+
+	// Forget the network too, so onboarding starts over.
+	if o.cfg.Unconfigured {
+		o.unconfigured = true
+		o.wifiAccessPoint.ssid = ""
+		o.wifi.status = wifiStatusOff
+	}
+
+	// Rebooting persists the defaults.
+	o.goOffline(o.cfg.bootTime(), true)
+}
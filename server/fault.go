@@ -0,0 +1,185 @@
+package server
+
+import (
+	"github.com/bionicrm/emulifx/clock"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// reorderTimeout is how long a datagram held back for reordering waits for
+// another one to overtake it before it is sent anyway.
+const reorderTimeout = 200 * time.Millisecond
+
+type (
+	// Faults configures how unreliable the emulated device's network is.
+	// Probabilities are in [0, 1].
+	Faults struct {
+		// Seed seeds the random source. Zero picks one from the clock, which
+		// is logged so the run can be reproduced.
+		Seed int64
+
+		// Drop is the probability that a received message is ignored, and
+		// separately that a response is never sent.
+		Drop float64
+
+		// Delay is added to every response.
+		Delay time.Duration
+
+		// Jitter is the upper bound of a random delay added on top of Delay.
+		Jitter time.Duration
+
+		// Duplicate is the probability that a response is sent twice.
+		Duplicate float64
+
+		// Reorder is the probability that a response is held back until the
+		// next one has been sent.
+		Reorder float64
+	}
+
+	// injector applies Faults to the receive and respond paths of a conn.
+	injector struct {
+		Faults
+
+		mu   sync.Mutex
+		clk  clock.Clock
+		rand *rand.Rand
+		held *datagram
+	}
+
+	datagram struct {
+		t     uint16
+		mac   uint64
+		data  []byte
+		raddr *net.UDPAddr
+	}
+)
+
+func (o Faults) enabled() bool {
+	return o.Drop > 0 || o.Delay > 0 || o.Jitter > 0 || o.Duplicate > 0 || o.Reorder > 0
+}
+
+// seeded returns o with a seed picked from the clock if it has none. The seed
+// is logged if faults are enabled, so the run can be reproduced.
+func (o Faults) seeded() Faults {
+	if o.Seed == 0 {
+		o.Seed = time.Now().UnixNano()
+	}
+	if o.enabled() {
+		log.Printf("fault injection enabled with seed %d", o.Seed)
+	}
+
+	return o
+}
+
+func newInjector(faults Faults, clk clock.Clock) *injector {
+	if !faults.enabled() {
+		return nil
+	}
+
+	return &injector{
+		Faults: faults,
+		clk:    clk,
+		rand:   rand.New(rand.NewSource(faults.Seed)),
+	}
+}
+
+// chance reports whether an event with probability p happens.
+func (o *injector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.rand.Float64() < p
+}
+
+// dropReceive reports whether a received message should be ignored.
+func (o *injector) dropReceive() bool {
+	return o != nil && o.chance(o.Drop)
+}
+
+// send passes d to write after applying the configured faults.
+func (o *injector) send(d datagram, write func(datagram)) {
+	if o.chance(o.Drop) {
+		return
+	}
+
+	copies := 1
+	if o.chance(o.Duplicate) {
+		copies++
+	}
+
+	for i := 0; i < copies; i++ {
+		o.schedule(d, write)
+	}
+}
+
+func (o *injector) schedule(d datagram, write func(datagram)) {
+	delay := o.Delay
+
+	o.mu.Lock()
+	if o.Jitter > 0 {
+		delay += time.Duration(o.rand.Int63n(int64(o.Jitter)))
+	}
+	o.mu.Unlock()
+
+	deliver := func() {
+		if o.chance(o.Reorder) && o.hold(d, write) {
+			return
+		}
+
+		write(d)
+		o.release(write)
+	}
+
+	if delay > 0 {
+		o.clk.AfterFunc(delay, deliver)
+	} else {
+		deliver()
+	}
+}
+
+// hold keeps d back until the next datagram is written. It reports false if
+// another datagram is already being held, in which case d goes out as usual.
+func (o *injector) hold(d datagram, write func(datagram)) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.held != nil {
+		return false
+	}
+
+	held := &d
+	o.held = held
+
+	o.clk.AfterFunc(reorderTimeout, func() {
+		o.mu.Lock()
+		if o.held != held {
+			o.mu.Unlock()
+			return
+		}
+		o.held = nil
+		o.mu.Unlock()
+
+		write(*held)
+	})
+
+	return true
+}
+
+// release writes the held datagram, if any, now that one has overtaken it.
+func (o *injector) release(write func(datagram)) {
+	o.mu.Lock()
+	held := o.held
+	o.held = nil
+	o.mu.Unlock()
+
+	if held != nil {
+		write(*held)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LifxPort is the port real clients expect devices to listen on.
+const LifxPort = 56700
+
+// StartFleet runs a headless device on LifxPort of each address in ips, which
+// must belong to this host, such as 127.0.0.2, 127.0.0.3 and so on. Broadcasts
+// to the port are received once and passed to every device, which answers from
+// its own address, just as on a real LAN. It returns when ctx is done or any
+// socket fails.
+func StartFleet(ctx context.Context, cfg Config, ips []net.IP) error {
+	cfg = setup(cfg)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		conns []*conn
+		devs  []*device
+	)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for i, ip := range ips {
+		devCfg := fleetConfig(cfg, i, ip)
+
+		conn, err := listen(devCfg.Addr, true)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		conn.faults = newInjector(devCfg.Faults, cfg.clock())
+
+		dev, err := openDevice(devCfg, conn)
+		if err != nil {
+			return err
+		}
+		devs = append(devs, dev)
+	}
+
+	// Sockets bound to a unicast address never see broadcasts, so one bound
+	// to every address relays them.
+	relay, err := listen(net.JoinHostPort("", strconv.Itoa(LifxPort)), true)
+	if err != nil {
+		return err
+	}
+	conns = append(conns, relay)
+
+	servers, err := startServers(cfg, devs)
+	defer shutdownServers(servers)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, len(devs)+1)
+
+	for _, dev := range devs {
+		go func(dev *device) {
+			errCh <- dev.start(ctx)
+		}(dev)
+	}
+	go func() {
+		errCh <- receive(relay, cfg.Strict, func(p packet) {
+			// Unicasts to other addresses of this host land here too, but
+			// aren't meant for the fleet.
+			if !p.header.tagged {
+				return
+			}
+
+			for _, dev := range devs {
+				dev.enqueue(p)
+			}
+		})
+	}()
+
+	// Stop everything once anything stops, then wait for the devices to
+	// flush their state.
+	err = <-errCh
+	cancel()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for i := 0; i < len(devs); i++ {
+		<-errCh
+	}
+
+	return err
+}
+
+// fleetConfig derives the configuration of the i-th device of a fleet, giving
+// it its own address, MAC and state file.
+func fleetConfig(cfg Config, i int, ip net.IP) Config {
+	cfg.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(LifxPort))
+
+	return memberConfig(cfg, i, ip.String())
+}
+
+// memberConfig derives the configuration of the i-th of several headless
+// devices, giving it its own MAC, seed and a state file marked with name.
+func memberConfig(cfg Config, i int, name string) Config {
+	cfg.Headless = true
+	cfg.Faults.Seed += int64(i)
+
+	switch {
+	case cfg.MAC != 0:
+		cfg.MAC += uint64(i)
+	case !cfg.RandomMAC:
+		cfg.MAC = DefaultMAC + uint64(i)
+	}
+
+	if cfg.StatePath != "" {
+		ext := filepath.Ext(cfg.StatePath)
+		cfg.StatePath = strings.TrimSuffix(cfg.StatePath, ext) + "-" + name + ext
+	}
+
+	return cfg
+}
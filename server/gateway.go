@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// StartGateway runs count headless devices behind the single socket at
+// cfg.Addr, like a bridge fronting several bulbs. Each device has its own MAC;
+// messages are routed by their target, and broadcasts and messages without a
+// target reach every device. It returns when ctx is done or the socket fails.
+func StartGateway(ctx context.Context, cfg Config, count int) error {
+	return runGateway(ctx, cfg, count, nil, nil)
+}
+
+// runGateway runs a gateway of count devices. If latency is set, it is called
+// for each device to choose how long it takes to respond. If observe is set,
+// it sees every message before it is routed.
+func runGateway(ctx context.Context, cfg Config, count int, latency func() time.Duration, observe func(packet)) error {
+	cfg = setup(cfg)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn, err := listen(cfg.Addr, false)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.faults = newInjector(cfg.Faults, cfg.clock())
+
+	var (
+		devs  []*device
+		byMAC = make(map[uint64]*device, count)
+	)
+
+	for i := 0; i < count; i++ {
+		dev, err := openDevice(memberConfig(cfg, i, strconv.Itoa(i)), conn)
+		if err != nil {
+			return err
+		}
+		if latency != nil {
+			dev.latency = latency()
+		}
+		devs = append(devs, dev)
+		byMAC[dev.mac] = dev
+	}
+
+	servers, err := startServers(cfg, devs)
+	defer shutdownServers(servers)
+	if err != nil {
+		return err
+	}
+
+	// The devices don't own the socket, so they only stop with ctx.
+	doneCh := make(chan struct{}, len(devs))
+	for _, dev := range devs {
+		go func(dev *device) {
+			dev.run(ctx, nil)
+			doneCh <- struct{}{}
+		}(dev)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- receive(conn, cfg.Strict, func(p packet) {
+			if observe != nil {
+				observe(p)
+			}
+
+			if p.header.tagged || p.header.target == 0 {
+				for _, dev := range devs {
+					dev.enqueue(p)
+				}
+				return
+			}
+
+			dev, ok := byMAC[p.header.target]
+			if !ok {
+				drop(p, dropTarget)
+				return
+			}
+			dev.enqueue(p)
+		})
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+	}
+
+	// Stop the devices and wait for them to flush their state.
+	cancel()
+	conn.Close()
+	for range devs {
+		<-doneCh
+	}
+
+	return err
+}
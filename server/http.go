@@ -0,0 +1,26 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// serveHTTP serves h on addr in the background. Binding errors are returned
+// straight away.
+func serveHTTP(addr string, h http.Handler) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: h}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	return srv, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+)
+
+const (
+	// DefaultMAC is used unless another one is asked for.
+	DefaultMAC = 0xd0738f86bfaf
+
+	// lifxOUI is the prefix of the MAC addresses of LIFX devices.
+	lifxOUI = 0xd073d5
+)
+
+// ParseMAC parses a MAC address such as "d0:73:d5:01:02:03".
+func ParseMAC(s string) (uint64, error) {
+	hw, err := net.ParseMAC(s)
+	if err != nil {
+		return 0, err
+	}
+	if len(hw) != 6 {
+		return 0, fmt.Errorf("%s is not a 48-bit MAC address", s)
+	}
+
+	var mac uint64
+	for _, b := range hw {
+		mac = mac<<8 | uint64(b)
+	}
+
+	return mac, nil
+}
+
+func formatMAC(mac uint64) string {
+	hw := make(net.HardwareAddr, 6)
+	for i := range hw {
+		hw[i] = byte(mac >> uint(40-8*i))
+	}
+
+	return hw.String()
+}
+
+// randomMAC returns a random address under the LIFX prefix.
+func randomMAC() (uint64, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[1:]); err != nil {
+		return 0, err
+	}
+
+	return lifxOUI<<24 | uint64(binary.BigEndian.Uint32(b[:])), nil
+}
+
+// assignMAC picks the device's address: the configured one, else one
+// restored from the state file, else a new random one if asked for, else
+// DefaultMAC. It must be called after the state has been loaded.
+func (o *device) assignMAC() error {
+	switch {
+	case o.cfg.MAC != 0:
+		o.mac = o.cfg.MAC
+	case o.mac != 0:
+	case o.cfg.RandomMAC:
+		mac, err := randomMAC()
+		if err != nil {
+			return err
+		}
+		o.mac = mac
+	default:
+		o.mac = DefaultMAC
+	}
+
+	o.log = log.New(log.Writer(), formatMAC(o.mac)+" ", log.Flags()|log.Lmsgprefix)
+
+	return nil
+}
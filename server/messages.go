@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"math"
+)
+
+// Message types that controlifx and implifx don't know about. Their payloads
+// are decoded here instead.
+const (
+	getTimeType   uint16 = 4
+	setTimeType   uint16 = 5
+	stateTimeType uint16 = 6
+
+	// Diagnostics for manufacturing.
+	getResetSwitchType         uint16 = 7
+	stateResetSwitchType       uint16 = 8
+	getDummyLoadType           uint16 = 9
+	setDummyLoadType           uint16 = 10
+	stateDummyLoadType         uint16 = 11
+	getMcuRailVoltageType      uint16 = 36
+	stateMcuRailVoltageType    uint16 = 37
+	setRebootType              uint16 = 38
+	setFactoryTestModeType     uint16 = 39
+	disableFactoryTestModeType uint16 = 40
+	stateFactoryTestModeType   uint16 = 41
+	lightGetRailVoltageType    uint16 = 108
+	lightStateRailVoltageType  uint16 = 109
+
+	// The connection to the cloud.
+	wanConnectKeyType   uint16 = 202
+	wanStateConnectType uint16 = 203
+	wanGetType          uint16 = 207
+	wanStateType        uint16 = 209
+	wanGetHostType      uint16 = 212
+	wanSetHostType      uint16 = 213
+	wanStateHostType    uint16 = 214
+
+	// Onboarding, answered over the device's own access point.
+	wifiGetType              uint16 = 301
+	wifiSetType              uint16 = 302
+	wifiStateType            uint16 = 303
+	wifiGetAccessPointsType  uint16 = 304
+	wifiSetAccessPointType   uint16 = 305
+	wifiStateAccessPointType uint16 = 306
+
+	sensorGetAmbientLightType    uint16 = 401
+	sensorStateAmbientLightType  uint16 = 402
+	sensorGetDimmerVoltageType   uint16 = 403
+	sensorStateDimmerVoltageType uint16 = 404
+
+	// Tags were replaced by locations and groups, and only legacy firmware
+	// knows them.
+	getTagsType        uint16 = 26
+	setTagsType        uint16 = 27
+	stateTagsType      uint16 = 28
+	getTagLabelsType   uint16 = 29
+	setTagLabelsType   uint16 = 30
+	stateTagLabelsType uint16 = 31
+)
+
+// Sizes of strings in payloads, which are padded with zeroes.
+const (
+	labelSize    = 32
+	ssidSize     = 32
+	passwordSize = 64
+	hostSize     = 32
+)
+
+// payloads maps each locally decoded message type to a constructor for its
+// payload, or to nil if it has none.
+var payloads = map[uint16]func() encoding.BinaryUnmarshaler{
+	getTimeType: nil,
+	setTimeType: func() encoding.BinaryUnmarshaler { return &timePayload{} },
+
+	getResetSwitchType:         nil,
+	getDummyLoadType:           nil,
+	setDummyLoadType:           func() encoding.BinaryUnmarshaler { return &onPayload{} },
+	getMcuRailVoltageType:      nil,
+	setRebootType:              nil,
+	setFactoryTestModeType:     func() encoding.BinaryUnmarshaler { return &onPayload{} },
+	disableFactoryTestModeType: nil,
+	lightGetRailVoltageType:    nil,
+
+	wanConnectKeyType: func() encoding.BinaryUnmarshaler { return &authKeyPayload{} },
+	wanGetType:        nil,
+	wanGetHostType:    nil,
+	wanSetHostType:    func() encoding.BinaryUnmarshaler { return &wanHostPayload{} },
+
+	wifiGetType:             func() encoding.BinaryUnmarshaler { return &wifiGetPayload{} },
+	wifiSetType:             func() encoding.BinaryUnmarshaler { return &wifiSetPayload{} },
+	wifiGetAccessPointsType: nil,
+	wifiSetAccessPointType:  func() encoding.BinaryUnmarshaler { return &setAccessPointPayload{} },
+
+	sensorGetAmbientLightType:  nil,
+	sensorGetDimmerVoltageType: nil,
+
+	getTagsType:      nil,
+	setTagsType:      func() encoding.BinaryUnmarshaler { return &tagsPayload{} },
+	getTagLabelsType: func() encoding.BinaryUnmarshaler { return &tagsPayload{} },
+	setTagLabelsType: func() encoding.BinaryUnmarshaler { return &tagLabelsPayload{} },
+}
+
+// implifxTypes are the message types implifx decodes. Anything not here or in
+// payloads is unknown, and is kept raw.
+var implifxTypes = map[uint16]bool{
+	controlifx.GetServiceType:      true,
+	controlifx.GetHostInfoType:     true,
+	controlifx.GetHostFirmwareType: true,
+	controlifx.GetWifiInfoType:     true,
+	controlifx.GetWifiFirmwareType: true,
+	controlifx.GetPowerType:        true,
+	controlifx.SetPowerType:        true,
+	controlifx.GetLabelType:        true,
+	controlifx.SetLabelType:        true,
+	controlifx.GetVersionType:      true,
+	controlifx.GetInfoType:         true,
+	controlifx.GetLocationType:     true,
+	controlifx.GetGroupType:        true,
+	controlifx.GetOwnerType:        true,
+	controlifx.SetOwnerType:        true,
+	controlifx.EchoRequestType:     true,
+	controlifx.LightGetType:        true,
+	controlifx.LightSetColorType:   true,
+	controlifx.LightGetPowerType:   true,
+	controlifx.LightSetPowerType:   true,
+}
+
+// knownType reports whether messages of type t are decoded.
+func knownType(t uint16) bool {
+	_, ok := payloads[t]
+	return ok || implifxTypes[t]
+}
+
+// decodePayload decodes the payload of a message of type t, if it is one of
+// the types in payloads.
+func decodePayload(t uint16, data []byte) (payload encoding.BinaryUnmarshaler, ok bool, err error) {
+	f, ok := payloads[t]
+	if !ok || f == nil {
+		return nil, ok, nil
+	}
+
+	payload = f()
+	err = payload.UnmarshalBinary(data)
+
+	return payload, true, err
+}
+
+// timePayload is the payload of SetTime and StateTime: the device's time in
+// Unix nanoseconds.
+type timePayload struct {
+	Time int64
+}
+
+func (o *timePayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("time payload is %d bytes, want 8", len(data))
+	}
+	o.Time = int64(binary.LittleEndian.Uint64(data))
+
+	return nil
+}
+
+func (o timePayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(o.Time))
+
+	return data, nil
+}
+
+// tagsPayload is the payload of SetTags, StateTags and GetTagLabels: a bit
+// field of tags.
+type tagsPayload struct {
+	Tags uint64
+}
+
+func (o *tagsPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 8 {
+		return fmt.Errorf("tags payload is %d bytes, want 8", len(data))
+	}
+	o.Tags = binary.LittleEndian.Uint64(data)
+
+	return nil
+}
+
+func (o tagsPayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, o.Tags)
+
+	return data, nil
+}
+
+// tagLabelsPayload is the payload of SetTagLabels and StateTagLabels: the
+// label of each tag in a bit field.
+type tagLabelsPayload struct {
+	Tags  uint64
+	Label string
+}
+
+func (o *tagLabelsPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 8+labelSize {
+		return fmt.Errorf("tag labels payload is %d bytes, want %d", len(data), 8+labelSize)
+	}
+	o.Tags = binary.LittleEndian.Uint64(data)
+	o.Label = unmarshalLabel(data[8 : 8+labelSize])
+
+	return nil
+}
+
+func (o tagLabelsPayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 8+labelSize)
+	binary.LittleEndian.PutUint64(data, o.Tags)
+	copy(data[8:], o.Label)
+
+	return data, nil
+}
+
+// unmarshalLabel decodes a string padded with zeroes.
+func unmarshalLabel(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+
+	return string(data)
+}
+
+// onPayload is the payload of messages that switch something on or off.
+type onPayload struct {
+	On bool
+}
+
+func (o *onPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("on payload is %d bytes, want 1", len(data))
+	}
+	o.On = data[0] != 0
+
+	return nil
+}
+
+func (o onPayload) MarshalBinary() ([]byte, error) {
+	if o.On {
+		return []byte{1}, nil
+	}
+
+	return []byte{0}, nil
+}
+
+// resetSwitchPayload is the payload of StateResetSwitch.
+type resetSwitchPayload struct {
+	Position uint8
+}
+
+func (o resetSwitchPayload) MarshalBinary() ([]byte, error) {
+	return []byte{o.Position}, nil
+}
+
+// voltagePayload is the payload of StateMcuRailVoltage,
+// LightStateRailVoltage and SensorStateDimmerVoltage, in millivolts.
+type voltagePayload struct {
+	Voltage uint32
+}
+
+func (o voltagePayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, o.Voltage)
+
+	return data, nil
+}
+
+// luxPayload is the payload of SensorStateAmbientLight.
+type luxPayload struct {
+	Lux float32
+}
+
+func (o luxPayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, math.Float32bits(o.Lux))
+
+	return data, nil
+}
+
+// wifiGetPayload is the payload of WifiGet.
+type wifiGetPayload struct {
+	Interface uint8
+}
+
+func (o *wifiGetPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 {
+		return fmt.Errorf("wifi get payload is %d bytes, want 1", len(data))
+	}
+	o.Interface = data[0]
+
+	return nil
+}
+
+// wifiSetPayload is the payload of WifiSet.
+type wifiSetPayload struct {
+	Interface uint8
+	Status    uint8
+}
+
+func (o *wifiSetPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("wifi set payload is %d bytes, want 2", len(data))
+	}
+	o.Interface = data[0]
+	o.Status = data[1]
+
+	return nil
+}
+
+// wifiStatePayload is the payload of WifiState.
+type wifiStatePayload struct {
+	Interface uint8
+	Status    uint8
+	IP4       [4]byte
+	IP6       [16]byte
+}
+
+func (o wifiStatePayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 2+4+16)
+	data[0] = o.Interface
+	data[1] = o.Status
+	copy(data[2:], o.IP4[:])
+	copy(data[6:], o.IP6[:])
+
+	return data, nil
+}
+
+// setAccessPointPayload is the payload of WifiSetAccessPoint.
+type setAccessPointPayload struct {
+	Interface uint8
+	SSID      string
+	Password  string
+	Security  uint8
+}
+
+func (o *setAccessPointPayload) UnmarshalBinary(data []byte) error {
+	if size := 1 + ssidSize + passwordSize + 1; len(data) < size {
+		return fmt.Errorf("set access point payload is %d bytes, want %d", len(data), size)
+	}
+	o.Interface = data[0]
+	o.SSID = unmarshalLabel(data[1 : 1+ssidSize])
+	o.Password = unmarshalLabel(data[1+ssidSize : 1+ssidSize+passwordSize])
+	o.Security = data[1+ssidSize+passwordSize]
+
+	return nil
+}
+
+// accessPointPayload is the payload of WifiStateAccessPoint, describing a
+// network the device can see.
+type accessPointPayload struct {
+	Interface uint8
+	SSID      string
+	Security  uint8
+	Strength  int16
+	Channel   uint16
+}
+
+func (o accessPointPayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 1+ssidSize+1+2+2)
+	data[0] = o.Interface
+	copy(data[1:1+ssidSize], o.SSID)
+	data[1+ssidSize] = o.Security
+	binary.LittleEndian.PutUint16(data[2+ssidSize:], uint16(o.Strength))
+	binary.LittleEndian.PutUint16(data[4+ssidSize:], o.Channel)
+
+	return data, nil
+}
+
+// authKeyPayload is the payload of WanConnectKey and WanStateConnect: the key
+// the device authenticates to the cloud with once claimed.
+type authKeyPayload struct {
+	AuthKey [32]byte
+}
+
+func (o *authKeyPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < len(o.AuthKey) {
+		return fmt.Errorf("auth key payload is %d bytes, want %d", len(data), len(o.AuthKey))
+	}
+	copy(o.AuthKey[:], data)
+
+	return nil
+}
+
+func (o authKeyPayload) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), o.AuthKey[:]...), nil
+}
+
+// wanStatePayload is the payload of WanState.
+type wanStatePayload struct {
+	Status uint8
+}
+
+func (o wanStatePayload) MarshalBinary() ([]byte, error) {
+	return []byte{o.Status}, nil
+}
+
+// wanHostPayload is the payload of WanSetHost and WanStateHost: where the
+// cloud is.
+type wanHostPayload struct {
+	Host               string
+	InsecureSkipVerify bool
+}
+
+func (o *wanHostPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < hostSize+1 {
+		return fmt.Errorf("wan host payload is %d bytes, want %d", len(data), hostSize+1)
+	}
+	o.Host = unmarshalLabel(data[:hostSize])
+	o.InsecureSkipVerify = data[hostSize] != 0
+
+	return nil
+}
+
+func (o wanHostPayload) MarshalBinary() ([]byte, error) {
+	data := make([]byte, hostSize+1)
+	copy(data, o.Host)
+	if o.InsecureSkipVerify {
+		data[hostSize] = 1
+	}
+
+	return data, nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bionicrm/emulifx/bus"
+	"github.com/bionicrm/emulifx/clock"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sourceWindow is how long a client source counts as active after its
+	// last message.
+	sourceWindow = 5 * time.Minute
+
+	// maxSources bounds how many sources are tracked at once. Clients
+	// beyond it aren't counted until others go quiet.
+	maxSources = 1 << 16
+)
+
+type (
+	// stats collects the counters and gauges served on /metrics in the
+	// Prometheus text exposition format.
+	stats struct {
+		mu sync.Mutex
+
+		received      map[typeKey]uint64
+		sent          map[typeKey]uint64
+		bytesReceived uint64
+		bytesSent     uint64
+		handlerErrors uint64
+		dropped       map[string]uint64
+
+		// sources holds when each client source was last seen, for
+		// those seen within sourceWindow.
+		sources map[uint32]time.Time
+		clk     clock.Clock
+
+		// lights holds the latest state of each running device, by MAC
+		// address.
+		lights map[uint64]bus.Light
+	}
+
+	// typeKey counts the messages of one type to or from one device.
+	typeKey struct {
+		mac uint64
+		t   uint16
+	}
+)
+
+var metrics = stats{
+	received: make(map[typeKey]uint64),
+	sent:     make(map[typeKey]uint64),
+	dropped:  make(map[string]uint64),
+	sources:  make(map[uint32]time.Time),
+	clk:      clock.Real,
+	lights:   make(map[uint64]bus.Light),
+}
+
+func (o *stats) receive(mac uint64, h header, n int) {
+	o.mu.Lock()
+	o.received[typeKey{mac, h.t}]++
+	o.bytesReceived += uint64(n)
+	o.seeSource(h.source)
+	o.mu.Unlock()
+}
+
+// seeSource records a message from source. It must be called with o locked.
+func (o *stats) seeSource(source uint32) {
+	now := o.clk.Now()
+
+	if _, ok := o.sources[source]; !ok && len(o.sources) >= maxSources {
+		o.expireSources(now)
+		if len(o.sources) >= maxSources {
+			return
+		}
+	}
+
+	o.sources[source] = now
+}
+
+// expireSources forgets the sources not seen within sourceWindow of now. It
+// must be called with o locked.
+func (o *stats) expireSources(now time.Time) {
+	for source, seen := range o.sources {
+		if now.Sub(seen) > sourceWindow {
+			delete(o.sources, source)
+		}
+	}
+}
+
+func (o *stats) send(mac uint64, t uint16, n int) {
+	o.mu.Lock()
+	o.sent[typeKey{mac, t}]++
+	o.bytesSent += uint64(n)
+	o.mu.Unlock()
+}
+
+func (o *stats) drop(reason string) {
+	o.mu.Lock()
+	o.dropped[reason]++
+	o.mu.Unlock()
+}
+
+func (o *stats) handlerError() {
+	o.mu.Lock()
+	o.handlerErrors++
+	o.mu.Unlock()
+}
+
+// watch keeps the light gauges of the device with address mac up to date
+// with the changes from sub. The device's gauges are removed once sub is
+// closed. Changes are published as they start, so the power level is where a
+// fade ends up rather than where it is now.
+func (o *stats) watch(mac uint64, sub *bus.Subscription) {
+	for l := range sub.C {
+		o.mu.Lock()
+		o.lights[mac] = l
+		o.mu.Unlock()
+	}
+
+	o.mu.Lock()
+	delete(o.lights, mac)
+	o.mu.Unlock()
+}
+
+func serveMetrics(addr string) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w)
+	})
+
+	return serveHTTP(addr, mux)
+}
+
+func (o *stats) write(w io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	writeByType(w, "emulifx_messages_received_total", "Messages received, by message type.", o.received)
+	writeByType(w, "emulifx_messages_sent_total", "Messages sent, by message type.", o.sent)
+
+	writeMetric(w, "emulifx_bytes_received_total", "counter", "Bytes received.", o.bytesReceived)
+	writeMetric(w, "emulifx_bytes_sent_total", "counter", "Bytes sent.", o.bytesSent)
+	writeMetric(w, "emulifx_handler_errors_total", "counter", "Messages whose handler returned an error.", o.handlerErrors)
+	o.expireSources(o.clk.Now())
+	writeMetric(w, "emulifx_client_sources", "gauge", "Distinct client source IDs seen in the last 5 minutes.", uint64(len(o.sources)))
+	o.writeByDevice(w, "emulifx_power_level", "Power level, or the level being faded to, by device.", func(l bus.Light) uint16 {
+		return l.PowerLevel
+	})
+	o.writeByDevice(w, "emulifx_brightness", "Current color brightness, by device.", func(l bus.Light) uint16 {
+		return l.Color.Brightness
+	})
+
+	fmt.Fprintln(w, "# HELP emulifx_messages_dropped_total Messages received but not processed, by reason.")
+	fmt.Fprintln(w, "# TYPE emulifx_messages_dropped_total counter")
+	for _, reason := range []string{dropFault, dropOffline, dropThrottle, dropTarget, dropSignal} {
+		fmt.Fprintf(w, "emulifx_messages_dropped_total{reason=%q} %d\n", reason, o.dropped[reason])
+	}
+
+	diag.mu.Lock()
+	fmt.Fprintln(w, "# HELP emulifx_malformed_frames_total Frames skipped because they could not be decoded, by reason.")
+	fmt.Fprintln(w, "# TYPE emulifx_malformed_frames_total counter")
+	for _, reason := range []string{badSize, badProtocol, badPayload} {
+		fmt.Fprintf(w, "emulifx_malformed_frames_total{reason=%q} %d\n", reason, diag.malformed[reason])
+	}
+	diag.mu.Unlock()
+}
+
+func writeMetric(w io.Writer, name, kind, help string, v uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, v)
+}
+
+func writeByType(w io.Writer, name, help string, counts map[typeKey]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+
+	keys := make([]typeKey, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mac != keys[j].mac {
+			return keys[i].mac < keys[j].mac
+		}
+		return keys[i].t < keys[j].t
+	})
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{mac=%q,type=\"%d\"} %d\n", name, formatMAC(k.mac), k.t, counts[k])
+	}
+}
+
+// writeByDevice writes a gauge of the value v reads from the light of each
+// running device. It must be called with o locked.
+func (o *stats) writeByDevice(w io.Writer, name, help string, v func(bus.Light) uint16) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+
+	macs := make([]uint64, 0, len(o.lights))
+	for mac := range o.lights {
+		macs = append(macs, mac)
+	}
+	sort.Slice(macs, func(i, j int) bool {
+		return macs[i] < macs[j]
+	})
+
+	for _, mac := range macs {
+		fmt.Fprintf(w, "%s{mac=%q} %d\n", name, formatMAC(mac), v(o.lights[mac]))
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"github.com/bionicrm/emulifx/bus"
+	"github.com/bionicrm/emulifx/clock"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStats() *stats {
+	return &stats{
+		received: make(map[typeKey]uint64),
+		sent:     make(map[typeKey]uint64),
+		dropped:  make(map[string]uint64),
+		sources:  make(map[uint32]time.Time),
+		clk:      clock.NewFake(epoch),
+		lights:   make(map[uint64]bus.Light),
+	}
+}
+
+func TestMetricsByDevice(t *testing.T) {
+	s := newStats()
+
+	a, b := bus.New(), bus.New()
+	a.Publish(bus.Light{PowerLevel: 65535})
+	b.Publish(bus.Light{PowerLevel: 0})
+
+	subA, subB := a.Subscribe(1), b.Subscribe(1)
+	doneA, doneB := make(chan struct{}), make(chan struct{})
+	go func() {
+		s.watch(0xd073d5000001, subA)
+		close(doneA)
+	}()
+	go func() {
+		s.watch(0xd073d5000002, subB)
+		close(doneB)
+	}()
+
+	s.receive(0xd073d5000001, header{t: 101}, 36)
+	s.receive(0xd073d5000002, header{t: 101}, 36)
+
+	// Each device keeps its own gauge once its watch has caught up.
+	for _, want := range []string{
+		`emulifx_power_level{mac="d0:73:d5:00:00:01"} 65535`,
+		`emulifx_power_level{mac="d0:73:d5:00:00:02"} 0`,
+	} {
+		waitFor(t, want, func() bool {
+			var buf bytes.Buffer
+			s.write(&buf)
+			return strings.Contains(buf.String(), want)
+		}, nil)
+	}
+
+	// Stopping the devices ends their watches and removes their gauges.
+	a.Unsubscribe(subA)
+	<-doneA
+
+	var buf bytes.Buffer
+	s.write(&buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		`emulifx_messages_received_total{mac="d0:73:d5:00:00:01",type="101"} 1`,
+		`emulifx_messages_received_total{mac="d0:73:d5:00:00:02",type="101"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `emulifx_power_level{mac="d0:73:d5:00:00:01"}`) {
+		t.Errorf("stopped device still has a power level gauge:\n%s", out)
+	}
+
+	b.Unsubscribe(subB)
+	<-doneB
+}
+
+func TestSourcesExpire(t *testing.T) {
+	s := newStats()
+	clk := s.clk.(*clock.Fake)
+
+	s.receive(1, header{source: 1}, 36)
+	clk.Advance(4 * time.Minute)
+	s.receive(1, header{source: 2}, 36)
+	clk.Advance(2 * time.Minute)
+
+	want := "emulifx_client_sources 1\n"
+	var buf bytes.Buffer
+	s.write(&buf)
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, buf.String())
+	}
+	if len(s.sources) != 1 {
+		t.Errorf("still tracking %d sources, want 1", len(s.sources))
+	}
+}
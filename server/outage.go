@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bionicrm/emulifx/bus"
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"strings"
+	"time"
+)
+
+// DefaultBootTime is how long a rebooting device stays silent unless told
+// otherwise.
+const DefaultBootTime = 2 * time.Second
+
+// PowerOn is what the light does when the device boots after a reboot or
+// losing power.
+type PowerOn string
+
+const (
+	// PowerOnLast comes on with the last persisted color. It's the default.
+	PowerOnLast PowerOn = "last"
+
+	// PowerOnRestore goes back to the last persisted color and power,
+	// staying off if it was off.
+	PowerOnRestore PowerOn = "restore"
+
+	// PowerOnWhite comes on at full brightness white.
+	PowerOnWhite PowerOn = "white"
+)
+
+func (o *PowerOn) UnmarshalText(text []byte) error {
+	switch p := PowerOn(text); p {
+	case "", PowerOnLast, PowerOnRestore, PowerOnWhite:
+		*o = p
+		return nil
+	}
+
+	return fmt.Errorf("unknown power-on behavior %q, want %q, %q or %q", text, PowerOnLast, PowerOnRestore, PowerOnWhite)
+}
+
+// bootTime returns how long the device takes to reboot.
+func (o Config) bootTime() time.Duration {
+	if o.BootTime <= 0 {
+		return DefaultBootTime
+	}
+
+	return o.BootTime
+}
+
+// setReboot reboots the device once the acknowledgement is out.
+func (o *device) setReboot(w writer) error {
+	o.goOffline(o.cfg.bootTime(), true)
+
+	return nil
+}
+
+// Outage takes the device off the network for For, starting At after it
+// starts. A reboot outage also power cycles the device, so it comes back with
+// its persisted state and its light on. It lasts the configured boot time if
+// For is zero.
+//
+// In flags and config files an outage is written as "[reboot@]AT[+FOR]", for
+// example "30s+10s" or "reboot@2m".
+type Outage struct {
+	At     time.Duration
+	For    time.Duration
+	Reboot bool
+}
+
+func (o *Outage) UnmarshalText(text []byte) error {
+	s := string(text)
+
+	*o = Outage{}
+	if strings.HasPrefix(s, "reboot@") {
+		o.Reboot = true
+		s = strings.TrimPrefix(s, "reboot@")
+	}
+
+	parts := strings.SplitN(s, "+", 2)
+
+	var err error
+	if o.At, err = time.ParseDuration(parts[0]); err != nil {
+		return fmt.Errorf("outage %q: %s", text, err)
+	}
+
+	if len(parts) == 2 {
+		if o.For, err = time.ParseDuration(parts[1]); err != nil {
+			return fmt.Errorf("outage %q: %s", text, err)
+		}
+	} else if !o.Reboot {
+		return fmt.Errorf("outage %q: missing +duration", text)
+	}
+
+	return nil
+}
+
+func (o Outage) MarshalText() ([]byte, error) {
+	s := o.At.String()
+	if o.For != 0 || !o.Reboot {
+		s += "+" + o.For.String()
+	}
+	if o.Reboot {
+		s = "reboot@" + s
+	}
+
+	return []byte(s), nil
+}
+
+// scheduleOutages arranges for each outage to start at its time.
+func (o *device) scheduleOutages(outages []Outage) {
+	for _, outage := range outages {
+		outage := outage
+		if outage.Reboot && outage.For == 0 {
+			outage.For = o.cfg.bootTime()
+		}
+
+		o.clk.AfterFunc(outage.At, func() {
+			o.post(func() {
+				o.goOffline(outage.For, outage.Reboot)
+			})
+		})
+	}
+}
+
+// offline reports whether the device is currently ignoring the network.
+func (o *device) offline() bool {
+	return o.clk.Now().UnixNano() < o.outage.until
+}
+
+// goOffline stops the device from responding for d. With reboot set, it also
+// loses power for that time. It must be called from update.
+func (o *device) goOffline(d time.Duration, reboot bool) {
+	if reboot {
+		o.log.Printf("rebooting for %s", d)
+
+		// Make sure the latest state makes it to flash.
+		o.saveState()
+
+		o.bus.Publish(bus.Light{
+			Color: o.state.color,
+		})
+	} else {
+		o.log.Printf("going offline for %s", d)
+	}
+
+	start := o.clk.Now()
+	o.outage.until = start.Add(d).UnixNano()
+	o.outage.generation++
+	generation := o.outage.generation
+
+	o.clk.AfterFunc(d, func() {
+		o.post(func() {
+			if generation != o.outage.generation {
+				return
+			}
+			o.comeOnline(start, reboot)
+		})
+	})
+}
+
+func (o *device) comeOnline(offlineSince time.Time, reboot bool) {
+	o.log.Println("back online")
+
+	if !reboot {
+		return
+	}
+
+	now := o.clk.Now().UnixNano()
+	o.info.downtime = now - offlineSince.UnixNano()
+	o.startTime = now
+
+	o.restoreState()
+
+	// The clock doesn't survive losing power.
+	o.time = int64(o.cfg.ClockSkew)
+
+	switch o.cfg.PowerOn {
+	case PowerOnRestore:
+	case PowerOnWhite:
+		o.powerLevel = 0xffff
+		o.state.color = controlifx.HSBK{Brightness: 0xffff, Kelvin: 3500}
+	default:
+		// Like a real bulb after a mains cycle, it comes back on.
+		o.powerLevel = 0xffff
+	}
+
+	o.notify(0)
+}
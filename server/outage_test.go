@@ -0,0 +1,56 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutageText(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		want Outage
+	}{
+		{"30s+10s", Outage{At: 30 * time.Second, For: 10 * time.Second}},
+		{"reboot@2m", Outage{At: 2 * time.Minute, Reboot: true}},
+		{"reboot@2m0s+5s", Outage{At: 2 * time.Minute, For: 5 * time.Second, Reboot: true}},
+	} {
+		var got Outage
+		if err := got.UnmarshalText([]byte(test.text)); err != nil {
+			t.Errorf("%s: %s", test.text, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s parsed as %+v, want %+v", test.text, got, test.want)
+		}
+
+		text, err := got.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again Outage
+		if err := again.UnmarshalText(text); err != nil || again != got {
+			t.Errorf("%s round tripped through %s to %+v, %v", test.text, text, again, err)
+		}
+	}
+}
+
+func TestScheduledRebootUsesBootTime(t *testing.T) {
+	dev, clk := newTestDevice(t, Config{BootTime: 10 * time.Second})
+
+	// The outage starts by posting to the device's loop, which isn't
+	// running.
+	dev.events = make(chan func(), 1)
+
+	var outage Outage
+	if err := outage.UnmarshalText([]byte("reboot@1m")); err != nil {
+		t.Fatal(err)
+	}
+	dev.scheduleOutages([]Outage{outage})
+
+	clk.Advance(time.Minute)
+	dev.update(<-dev.events)
+
+	if want := epoch.Add(time.Minute + 10*time.Second).UnixNano(); dev.outage.until != want {
+		t.Errorf("back at %s, want %s", time.Unix(0, dev.outage.until), time.Unix(0, want))
+	}
+}
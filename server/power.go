@@ -0,0 +1,39 @@
+package server
+
+import "time"
+
+// minPowerFade is the quickest a bulb turns on or off. Real bulbs never snap.
+const minPowerFade = 350 * time.Millisecond
+
+// currentPower returns the power level right now, partway through any fade.
+func (o *device) currentPower() uint16 {
+	now := o.clk.Now().UnixNano()
+	if now >= o.power.start+o.power.duration {
+		return o.powerLevel
+	}
+
+	f := float64(now-o.power.start) / float64(o.power.duration)
+	return uint16(float64(o.power.from) + f*(float64(o.powerLevel)-float64(o.power.from)))
+}
+
+// fadePower fades the power to level over duration milliseconds, or
+// minPowerFade if that's quicker. The color, brightness included, is left as
+// it is. It must be called from update.
+func (o *device) fadePower(level uint16, duration uint32) {
+	d := time.Duration(duration) * time.Millisecond
+	if d < minPowerFade {
+		d = minPowerFade
+	}
+
+	o.power.from = o.currentPower()
+	o.power.start = o.clk.Now().UnixNano()
+	o.power.duration = int64(d)
+	o.powerLevel = level
+
+	o.notify(uint32(d / time.Millisecond))
+}
+
+// load returns how hard the light is being driven, from 0 to 1.
+func (o *device) load() float64 {
+	return float64(o.currentPower()) / 0xffff * float64(o.state.color.Brightness) / 0xffff
+}
@@ -0,0 +1,29 @@
+package server
+
+import "fmt"
+
+// Profile picks the firmware generation the device emulates.
+type Profile string
+
+const (
+	// ModernProfile is current firmware. It's the default.
+	ModernProfile Profile = "modern"
+
+	// LegacyProfile is the original firmware, which also supports the tags
+	// messages.
+	LegacyProfile Profile = "legacy"
+)
+
+func (o *Profile) UnmarshalText(text []byte) error {
+	switch p := Profile(text); p {
+	case "", ModernProfile, LegacyProfile:
+		*o = p
+		return nil
+	}
+
+	return fmt.Errorf("unknown profile %q, want %q or %q", text, ModernProfile, LegacyProfile)
+}
+
+func (o Profile) legacy() bool {
+	return o == LegacyProfile
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import "syscall"
+
+// reuseAddr lets several sockets bind the same port, so that devices on
+// different addresses and the broadcast relay can all use it.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); err != nil {
+		return err
+	}
+
+	return sockErr
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// nightLux is what the ambient light sensor reads at night.
+const nightLux = 0.1
+
+func (o *device) sensorGetAmbientLight(w writer) error {
+	o.readings.Lock()
+	if !o.sensors.luxSet {
+		o.sensorAmbientLightLux = float32(o.cfg.ambientLux(o.sensors.since, o.clk.Now()))
+	}
+	lux := o.sensorAmbientLightLux
+	o.readings.Unlock()
+
+	return w(true, sensorStateAmbientLightType, luxPayload{
+		Lux: lux,
+	})
+}
+
+func (o *device) sensorGetDimmerVoltage(w writer) error {
+	return w(true, sensorStateDimmerVoltageType, voltagePayload{
+		Voltage: o.sensorDimmerVoltage,
+	})
+}
+
+// setAmbientLux makes the ambient light sensor read lux until told otherwise.
+// A negative lux goes back to the configured reading. It must be called from
+// update.
+func (o *device) setAmbientLux(lux float64) {
+	o.sensors.luxSet = lux >= 0
+	if o.sensors.luxSet {
+		o.sensorAmbientLightLux = float32(lux)
+	}
+}
+
+// ambientLux returns the configured ambient light at now for a device started
+// at since, in Unix nanoseconds.
+func (o Config) ambientLux(since int64, now time.Time) float64 {
+	if o.Day <= 0 {
+		return o.AmbientLux
+	}
+
+	// Days start at the time of day here, and a 24 hour day keeps pace
+	// with it.
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	start := float64(time.Unix(0, since).Sub(midnight)) / float64(24*time.Hour)
+	phase := start + float64(now.UnixNano()-since)/float64(o.Day)
+
+	// The sun is up from 6 to 18 and highest at noon.
+	daylight := math.Max(0, math.Sin(2*math.Pi*(phase-0.25)))
+
+	return nightLux + (o.AmbientLux-nightLux)*daylight
+}
@@ -1,438 +1,693 @@
 package server
 
 import (
+	"context"
 	"encoding"
+	"github.com/bionicrm/emulifx/clock"
 	"github.com/bionicrm/emulifx/ui"
 	"gopkg.in/lifx-tools/controlifx.v1"
 	"gopkg.in/lifx-tools/implifx.v1"
 	"log"
 	"net"
+	"net/http"
 	"time"
 )
 
 type writer func(always bool, t uint16, msg encoding.BinaryMarshaler) error
 
-var (
-	bulb struct {
-		service             int8
-		port                uint16
-		time                int64
-		resetSwitchPosition uint8
-		dummyLoadOn         bool
-		hostInfo            struct {
-			signal         float32
-			tx             uint32
-			rx             uint32
-			mcuTemperature uint16
-		}
-		hostFirmware struct {
-			build   int64
-			install int64
-			version uint32
-		}
-		wifiInfo struct {
-			signal         float32
-			tx             uint32
-			rx             uint32
-			mcuTemperature int16
-		}
-		wifiFirmware struct {
-			build   int64
-			install int64
-			version uint32
-		}
-		powerLevel uint16
-		label      string
-		tags       struct {
-			tags  int64
-			label string
-		}
-		version struct {
-			vendor  uint32
-			product uint32
-			version uint32
-		}
-		info struct {
-			time     int64
-			uptime   int64
-			downtime int64
-		}
-		mcuRailVoltage  uint32
-		factoryTestMode struct {
-			on       bool
-			disabled bool
-		}
-		site     [6]byte
-		location struct {
-			location  [16]byte
-			label     string
-			updatedAt int64
-		}
-		group struct {
-			group     [16]byte
-			label     string
-			updatedAt int64
-		}
-		owner struct {
-			owner     [16]byte
-			label     string
-			updatedAt int64
-		}
-		state struct {
-			color controlifx.HSBK
-			dim   int16
-			label string
-			tags  uint64
-		}
-		lightRailVoltage  uint32
-		lightTemperature  int16
-		lightSimpleEvents []struct {
-			time     int64
-			power    uint16
-			duration uint32
-			waveform int8
-			max      uint16
-		}
-		wanStatus  int8
-		wanAuthKey [32]byte
-		wanHost    struct {
-			host               string
-			insecureSkipVerify bool
-		}
-		wifi struct {
-			networkInterface int8
-			status           int8
-		}
-		wifiAccessPoints struct {
-			networkInterface int8
-			ssid             string
-			security         int8
-			strength         int16
-			channel          uint16
-		}
-		wifiAccessPoint struct {
-			networkInterface int8
-			ssid             string
-			pass             string
-			security         int8
-		}
-		sensorAmbientLightLux float32
-		sensorDimmerVoltage   uint32
+// uiBufferSize is how many changes the window may fall behind by.
+const uiBufferSize = 8
 
-		// Extra.
-		startTime int64
-	}
+// Config holds the options for an emulated device.
+type Config struct {
+	// Addr is the address to bind to.
+	Addr string
 
-	winStopCh   = make(chan interface{})
-	winActionCh = make(chan interface{})
-)
+	// HasColor selects the Color 1000 rather than the White 800.
+	HasColor bool
+
+	// Profile picks the firmware generation, ModernProfile if empty.
+	Profile Profile
+
+	// MAC, if set, is the device's address. Otherwise, with RandomMAC set,
+	// a random LIFX address is generated and kept in the state file; failing
+	// that, DefaultMAC is used.
+	MAC       uint64
+	RandomMAC bool
+
+	// MetricsAddr, if set, is the address to serve Prometheus metrics on.
+	MetricsAddr string
+
+	// ControlAddr, if set, is the address to serve the control API on.
+	ControlAddr string
+
+	// StatePath, if set, is the file the device persists its state to.
+	StatePath string
+
+	// Outages schedules times for the device to go offline or reboot.
+	Outages []Outage
+
+	// BootTime is how long a reboot takes, DefaultBootTime if unset, and
+	// PowerOn is what the light does afterwards, PowerOnLast if unset.
+	BootTime time.Duration
+	PowerOn  PowerOn
+
+	// Faults configures packet loss, latency, duplication and reordering.
+	Faults Faults
+
+	// Throttle limits how fast the device processes messages.
+	Throttle Throttle
+
+	// Headless runs the device without a window.
+	Headless bool
+
+	// Workers is how many messages may be handled at once. Messages from
+	// the same source are always handled in order.
+	Workers int
+
+	// RSSI is the Wi-Fi signal strength in dBm, or zero for DefaultRSSI.
+	// With Drift set, it wanders around that and the MCU temperature gets
+	// noisy, as on a real bulb.
+	RSSI  float64
+	Drift bool
+
+	// Signal scripts the signal strength over time instead.
+	Signal SignalTimeline
+
+	// AmbientLux is what the ambient light sensor reads. With Day set, it
+	// instead follows a day/night curve peaking at AmbientLux at noon, with
+	// days lasting Day; a 24 hour day follows the time of day here.
+	AmbientLux float64
+	Day        time.Duration
 
-func Start(addr string, hasColor bool) error {
-	defer func() {
-		winStopCh <- 0
-	}()
+	// DimmerVoltage is what the dimmer sensor reads, in millivolts.
+	DimmerVoltage uint32
+
+	// Unconfigured starts the device waiting to be onboarded onto one of
+	// AccessPoints, DefaultAccessPoints if empty, unless its state file
+	// says it already has been.
+	Unconfigured bool
+	AccessPoints []AccessPoint
+
+	// CloudConnected reports the device as connected to the LIFX cloud.
+	// With CloudAddr set, a stand-in cloud is served there over TLS
+	// instead, and the device connects to it while CloudConnected, until
+	// the control API says otherwise.
+	CloudConnected bool
+	CloudAddr      string
+
+	// Trace logs every message received, sent or dropped.
+	Trace bool
+
+	// LogUnknown logs every message of an unknown type with its raw
+	// payload, and Canned answers messages with prepared responses, so
+	// undocumented traffic can be reproduced without code changes.
+	LogUnknown bool
+	Canned     []CannedResponse
+
+	// Clock, if set, replaces the wall clock, so tests can control time.
+	Clock clock.Clock
+
+	// ClockSkew is how far ahead of the host the device's clock starts out,
+	// or behind if negative. Clients can correct it with SetTime.
+	ClockSkew time.Duration
+
+	// Strict makes a malformed frame fatal instead of logging and skipping
+	// it, for conformance testing of clients.
+	Strict bool
+}
+
+// ShutdownTimeout bounds how long Start waits for the renderer and the HTTP
+// servers to stop once it is done.
+const ShutdownTimeout = 5 * time.Second
+
+// Start runs an emulated device until ctx is done, the window is closed or
+// the socket fails.
+func Start(ctx context.Context, cfg Config) error {
+	cfg = setup(cfg)
 
 	// Connect.
-	conn, err := connect(addr)
+	conn, err := listen(cfg.Addr, false)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	// Mock MAC.
-	conn.Mac = 0xd0738f86bfaf
+	conn.faults = newInjector(cfg.Faults, cfg.clock())
 
-	configureBulb(conn.Port(), hasColor)
+	dev, err := openDevice(cfg, conn)
+	if err != nil {
+		return err
+	}
 
-	var windowClosed bool
+	servers, err := startServers(cfg, []*device{dev})
+	defer shutdownServers(servers)
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		if err := ui.ShowWindow(hasColor, conn.LocalAddr().String(), winStopCh, winActionCh); err != nil {
-			log.Fatalln(err)
-		}
+	var (
+		stopWindow   = make(chan interface{})
+		windowClosed = make(chan struct{})
+	)
 
-		windowClosed = true
-		conn.Close()
-	}()
+	if !cfg.Headless {
+		sub := dev.bus.Subscribe(uiBufferSize)
 
-	for {
-		n, raddr, recMsg, err := conn.Receive()
-		if err != nil {
-			if windowClosed {
-				return nil
+		go func() {
+			if err := ui.ShowWindow(dev.clk, cfg.HasColor, formatMAC(dev.mac), conn.LocalAddr().String(), stopWindow, sub.C); err != nil {
+				log.Fatalln(err)
 			}
-			if err.(net.Error).Temporary() {
-				continue
+
+			close(windowClosed)
+			conn.Close()
+		}()
+		defer func() {
+			close(stopWindow)
+
+			select {
+			case <-windowClosed:
+			case <-time.After(ShutdownTimeout):
+				log.Println("timed out waiting for the window to close")
 			}
-			return err
+		}()
+	}
+
+	err = dev.start(ctx)
+
+	select {
+	case <-windowClosed:
+		return nil
+	default:
+		return err
+	}
+}
+
+// setup applies the process-wide parts of cfg, and returns it with its seed
+// picked.
+func setup(cfg Config) Config {
+	tracing = cfg.Trace
+	cfg.Faults = cfg.Faults.seeded()
+
+	return cfg
+}
+
+// clock returns the source of time for devices, the wall clock unless Clock
+// is set.
+func (o Config) clock() clock.Clock {
+	if o.Clock == nil {
+		return clock.Real
+	}
+
+	return o.Clock
+}
+
+// openDevice creates a device answering on conn and restores its persisted
+// state.
+func openDevice(cfg Config, conn *conn) (*device, error) {
+	dev := newDevice(cfg, conn)
+
+	if err := dev.loadState(cfg.StatePath); err != nil {
+		return nil, err
+	}
+	if err := dev.assignMAC(); err != nil {
+		return nil, err
+	}
+	dev.log.Printf("listening on %s", conn.LocalAddr())
+	dev.update(func() {
+		dev.notify(0)
+	})
+
+	return dev, nil
+}
+
+// startServers starts the HTTP servers asked for in cfg. The servers that
+// were started are returned even if another fails.
+func startServers(cfg Config, devs []*device) (servers []*http.Server, err error) {
+	if cfg.MetricsAddr != "" {
+		srv, err := serveMetrics(cfg.MetricsAddr)
+		if err != nil {
+			return servers, err
 		}
+		servers = append(servers, srv)
+	}
+	if cfg.ControlAddr != "" {
+		srv, err := serveControl(cfg.ControlAddr, devs)
+		if err != nil {
+			return servers, err
+		}
+		servers = append(servers, srv)
+	}
+	if cfg.CloudAddr != "" {
+		srv, err := serveCloud(cfg.CloudAddr)
+		if err != nil {
+			return servers, err
+		}
+		servers = append(servers, srv)
+	}
 
-		bulb.wifiInfo.rx += uint32(n)
+	return
+}
 
-		if err := handle(recMsg, func(always bool, t uint16, payload encoding.BinaryMarshaler) error {
-			tx, err := conn.Respond(always, raddr, recMsg, t, payload)
-			bulb.wifiInfo.tx += uint32(tx)
+func shutdownServers(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
 
-			return err
-		}); err != nil {
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
 			log.Println(err)
 		}
 	}
 }
 
-func connect(addr string) (conn implifx.Connection, err error) {
-	host, portStr, err := net.SplitHostPort(addr)
-	if err != nil {
-		return conn, err
-	}
+// receive passes each message received on conn to deliver until the
+// connection fails.
+func receive(conn *conn, strict bool, deliver func(packet)) error {
+	for {
+		p, err := conn.receive()
+		if err != nil {
+			if frameErr, ok := err.(*FrameError); ok {
+				diag.report(p.raddr, frameErr)
+
+				if strict {
+					return err
+				}
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			return err
+		}
 
-	return implifx.ListenOnOtherPort(host, portStr)
+		traceReceive(p)
+		deliver(p)
+	}
 }
 
-func configureBulb(port uint16, hasColor bool) {
-	bulb.service = controlifx.UdpService
-	bulb.port = port
+func (o *device) configure(port uint16, hasColor bool) {
+	o.service = controlifx.UdpService
+	o.port = port
 
 	// Mock HostFirmware.
-	bulb.hostFirmware.build = 1467178139000000000
-	bulb.hostFirmware.version = 1968197120
+	o.hostFirmware.build = 1467178139000000000
+	o.hostFirmware.version = 1968197120
+
+	o.mcuRailVoltage = mcuRailVoltage
+	o.lightRailVoltage = lightRailVoltage
+	o.sensorDimmerVoltage = o.cfg.DimmerVoltage
+
+	// Without a stand-in cloud, the connection is whatever it's configured
+	// to be.
+	o.wanHost.host = DefaultCloudHost
+	o.wanStatus = wanStatusDisconnected
+	if o.cfg.CloudConnected && o.cfg.CloudAddr == "" {
+		o.wanStatus = wanStatusConnected
+	}
+	if o.cfg.CloudAddr != "" {
+		o.wanHost.host = o.cfg.CloudAddr
+		o.wanHost.insecureSkipVerify = true
+		o.cloud.wanted = o.cfg.CloudConnected
+	}
+
+	// Configured devices are already on a network.
+	o.unconfigured = o.cfg.Unconfigured
+	o.wifi.networkInterface = int8(wifiInterfaceStation)
+	o.wifi.status = wifiStatusConnected
+	if o.unconfigured {
+		o.wifi.status = wifiStatusOff
+	}
 
-	// Mock WifiInfo.
-	bulb.wifiInfo.signal = 1e-5
+	// The device's clock starts out skewed from the host's, if asked to.
+	o.time = int64(o.cfg.ClockSkew)
 
 	// Mock WifiFirmware.
-	bulb.wifiFirmware.build = 1456093684000000000
+	o.wifiFirmware.build = 1456093684000000000
 
 	if hasColor {
-		bulb.version.vendor = controlifx.Color1000VendorId
-		bulb.version.product = controlifx.Color1000ProductId
+		o.version.vendor = controlifx.Color1000VendorId
+		o.version.product = controlifx.Color1000ProductId
 	} else {
-		bulb.version.vendor = controlifx.White800HighVVendorId
-		bulb.version.product = controlifx.White800HighVProductId
+		o.version.vendor = controlifx.White800HighVVendorId
+		o.version.product = controlifx.White800HighVProductId
 	}
 
-	bulb.state.color.Kelvin = 3500
+	o.state.color.Kelvin = 3500
 
 	// Extra.
-	bulb.startTime = time.Now().UnixNano()
+	o.startTime = o.clk.Now().UnixNano()
+
+	// Start cold, with the signal where it was configured.
+	o.sensors.rand = newSensorRand(o.cfg)
+	o.sensors.temperature = ambientTemperature
+	o.sensors.since = o.startTime
+	o.sensors.at = o.startTime
+	o.sample()
+}
+
+// readTypes are the messages that only read the device's state. They are
+// handled alongside each other, with the device read locked.
+var readTypes = map[uint16]bool{
+	getTimeType:                    true,
+	getResetSwitchType:             true,
+	getDummyLoadType:               true,
+	getMcuRailVoltageType:          true,
+	lightGetRailVoltageType:        true,
+	wanGetType:                     true,
+	wanGetHostType:                 true,
+	wifiGetType:                    true,
+	wifiGetAccessPointsType:        true,
+	sensorGetAmbientLightType:      true,
+	sensorGetDimmerVoltageType:     true,
+	getTagsType:                    true,
+	getTagLabelsType:               true,
+	controlifx.GetServiceType:      true,
+	controlifx.GetHostInfoType:     true,
+	controlifx.GetHostFirmwareType: true,
+	controlifx.GetWifiInfoType:     true,
+	controlifx.GetWifiFirmwareType: true,
+	controlifx.GetPowerType:        true,
+	controlifx.GetLabelType:        true,
+	controlifx.GetVersionType:      true,
+	controlifx.GetInfoType:         true,
+	controlifx.GetLocationType:     true,
+	controlifx.GetGroupType:        true,
+	controlifx.GetOwnerType:        true,
+	controlifx.EchoRequestType:     true,
+	controlifx.LightGetType:        true,
+	controlifx.LightGetPowerType:   true,
+}
+
+// handle answers p through w. It reports whether the device accepted p at
+// all; ignored messages aren't acknowledged either.
+func (o *device) handle(p packet, w writer) (accepted bool, err error) {
+	if legacyTypes[p.header.t] && !o.cfg.Profile.legacy() {
+		return false, nil
+	}
+	if o.unconfigured && !onboardingTypes[p.header.t] {
+		return false, nil
+	}
+
+	return true, o.dispatch(p, w)
 }
 
-func handle(msg implifx.ReceivableLanMessage, w writer) error {
-	switch msg.Header.ProtocolHeader.Type {
+// dispatch passes p to the handler for its type.
+func (o *device) dispatch(p packet, w writer) error {
+	msg := p.msg
+
+	if !knownType(p.header.t) {
+		o.logUnknown(p)
+	}
+	if c, ok := o.cfg.canned(p.header.t); ok {
+		return w(true, c.Response, c.Payload)
+	}
+
+	switch p.header.t {
+	case getTimeType:
+		return o.getTime(w)
+	case setTimeType:
+		return o.setTime(p.payload.(*timePayload), w)
+	case getResetSwitchType:
+		return o.getResetSwitch(w)
+	case getDummyLoadType:
+		return o.getDummyLoad(w)
+	case setDummyLoadType:
+		return o.setDummyLoad(p.payload.(*onPayload), w)
+	case getMcuRailVoltageType:
+		return o.getMcuRailVoltage(w)
+	case setFactoryTestModeType:
+		return o.setFactoryTestMode(p.payload.(*onPayload), w)
+	case disableFactoryTestModeType:
+		return o.disableFactoryTestMode(w)
+	case lightGetRailVoltageType:
+		return o.lightGetRailVoltage(w)
+	case wanGetType:
+		return o.wanGet(w)
+	case wanConnectKeyType:
+		return o.wanConnectKey(p.payload.(*authKeyPayload), w)
+	case wanGetHostType:
+		return o.wanGetHost(w)
+	case wanSetHostType:
+		return o.wanSetHost(p.payload.(*wanHostPayload), w)
+	case wifiGetType:
+		return o.wifiGet(p.payload.(*wifiGetPayload), w)
+	case wifiSetType:
+		return o.wifiSet(p.payload.(*wifiSetPayload), w)
+	case wifiGetAccessPointsType:
+		return o.wifiGetAccessPoints(w)
+	case wifiSetAccessPointType:
+		return o.wifiSetAccessPoint(p.payload.(*setAccessPointPayload), w)
+	case sensorGetAmbientLightType:
+		return o.sensorGetAmbientLight(w)
+	case sensorGetDimmerVoltageType:
+		return o.sensorGetDimmerVoltage(w)
+	case setRebootType:
+		return o.setReboot(w)
+	case getTagsType:
+		return o.getTags(w)
+	case setTagsType:
+		return o.setTags(p.payload.(*tagsPayload), w)
+	case getTagLabelsType:
+		return o.getTagLabels(p.payload.(*tagsPayload), w)
+	case setTagLabelsType:
+		return o.setTagLabels(p.payload.(*tagLabelsPayload), w)
 	case controlifx.GetServiceType:
-		return getService(w)
+		return o.getService(w)
 	case controlifx.GetHostInfoType:
-		return getHostInfo(w)
+		return o.getHostInfo(w)
 	case controlifx.GetHostFirmwareType:
-		return getHostFirmware(w)
+		return o.getHostFirmware(w)
 	case controlifx.GetWifiInfoType:
-		return getWifiInfo(w)
+		return o.getWifiInfo(w)
 	case controlifx.GetWifiFirmwareType:
-		return getWifiFirmware(w)
+		return o.getWifiFirmware(w)
 	case controlifx.GetPowerType:
-		return getPower(w)
+		return o.getPower(w)
 	case controlifx.SetPowerType:
-		return setPower(msg, w)
+		return o.setPower(msg, w)
 	case controlifx.GetLabelType:
-		return getLabel(w)
+		return o.getLabel(w)
 	case controlifx.SetLabelType:
-		return setLabel(msg, w)
+		return o.setLabel(msg, w)
 	case controlifx.GetVersionType:
-		return getVersion(w)
+		return o.getVersion(w)
 	case controlifx.GetInfoType:
-		return getInfo(w)
+		return o.getInfo(w)
 	case controlifx.GetLocationType:
-		return getLocation(w)
+		return o.getLocation(w)
 	case controlifx.GetGroupType:
-		return getGroup(w)
+		return o.getGroup(w)
 	case controlifx.GetOwnerType:
-		return getOwner(w)
+		return o.getOwner(w)
 	case controlifx.SetOwnerType:
-		return setOwner(msg, w)
+		return o.setOwner(msg, w)
 	case controlifx.EchoRequestType:
-		return echoRequest(msg, w)
+		return o.echoRequest(msg, w)
 	case controlifx.LightGetType:
-		return lightGet(w)
+		return o.lightGet(w)
 	case controlifx.LightSetColorType:
-		return lightSetColor(msg, w)
+		return o.lightSetColor(msg, w)
 	case controlifx.LightGetPowerType:
-		return lightGetPower(w)
+		return o.lightGetPower(w)
 	case controlifx.LightSetPowerType:
-		return lightSetPower(msg, w)
+		return o.lightSetPower(msg, w)
 	}
 
 	return nil
 }
 
-func getService(w writer) error {
+func (o *device) getService(w writer) error {
 	return w(true, controlifx.StateServiceType, &implifx.StateServiceLanMessage{
 		Service: controlifx.UdpService,
-		Port:    uint32(bulb.port),
+		Port:    uint32(o.port),
 	})
 }
 
-func getHostInfo(w writer) error {
-	return w(true, controlifx.StateHostInfoType, &implifx.StateHostInfoLanMessage{})
+func (o *device) getHostInfo(w writer) error {
+	o.readings.Lock()
+	o.sample()
+	info := o.hostInfo
+	o.readings.Unlock()
+
+	return w(true, controlifx.StateHostInfoType, &implifx.StateHostInfoLanMessage{
+		Signal:         info.signal,
+		Tx:             info.tx,
+		Rx:             info.rx,
+		McuTemperature: info.mcuTemperature,
+	})
 }
 
-func getHostFirmware(w writer) error {
+func (o *device) getHostFirmware(w writer) error {
 	return w(true, controlifx.StateHostFirmwareType, &implifx.StateHostFirmwareLanMessage{
-		Build:   uint64(bulb.hostFirmware.build),
-		Version: bulb.hostFirmware.version,
+		Build:   uint64(o.hostFirmware.build),
+		Version: o.hostFirmware.version,
 	})
 }
 
-func getWifiInfo(w writer) error {
+func (o *device) getWifiInfo(w writer) error {
+	o.readings.Lock()
+	o.sample()
+	info := o.wifiInfo
+	o.readings.Unlock()
+
 	return w(true, controlifx.StateWifiInfoType, &implifx.StateWifiInfoLanMessage{
-		Signal: bulb.wifiInfo.signal,
-		Tx:     bulb.wifiInfo.tx,
-		Rx:     bulb.wifiInfo.rx,
+		Signal:         info.signal,
+		Tx:             info.tx,
+		Rx:             info.rx,
+		McuTemperature: info.mcuTemperature,
 	})
 }
 
-func getWifiFirmware(w writer) error {
+func (o *device) getWifiFirmware(w writer) error {
 	return w(true, controlifx.StateWifiFirmwareType, &implifx.StateWifiFirmwareLanMessage{
-		Build:   uint64(bulb.wifiFirmware.build),
-		Version: bulb.wifiFirmware.version,
+		Build:   uint64(o.wifiFirmware.build),
+		Version: o.wifiFirmware.version,
 	})
 }
 
-func getPower(w writer) error {
+func (o *device) getPower(w writer) error {
 	return w(true, controlifx.StatePowerType, &implifx.StatePowerLanMessage{
-		Level: bulb.powerLevel,
+		Level: o.currentPower(),
 	})
 }
 
-func setPower(msg implifx.ReceivableLanMessage, w writer) error {
+func (o *device) setPower(msg implifx.ReceivableLanMessage, w writer) error {
 	responsePayload := &implifx.StatePowerLanMessage{
-		Level: bulb.powerLevel,
-	}
-	bulb.powerLevel = msg.Payload.(*implifx.SetPowerLanMessage).Level
-
-	winActionCh <- ui.PowerAction{
-		On: bulb.powerLevel == 0xffff,
+		Level: o.currentPower(),
 	}
+	o.fadePower(msg.Payload.(*implifx.SetPowerLanMessage).Level, 0)
 
 	return w(false, controlifx.StatePowerType, responsePayload)
 }
 
-func getLabel(w writer) error {
+func (o *device) getLabel(w writer) error {
 	return w(true, controlifx.StateLabelType, &implifx.StateLabelLanMessage{
-		Label: bulb.label,
+		Label: o.label,
 	})
 }
 
-func setLabel(msg implifx.ReceivableLanMessage, w writer) error {
-	bulb.label = msg.Payload.(*implifx.SetLabelLanMessage).Label
+func (o *device) setLabel(msg implifx.ReceivableLanMessage, w writer) error {
+	o.label = msg.Payload.(*implifx.SetLabelLanMessage).Label
 
 	return w(false, controlifx.StateLabelType, &implifx.StateLabelLanMessage{
-		Label: bulb.label,
+		Label: o.label,
 	})
 }
 
-func getVersion(w writer) error {
+func (o *device) getVersion(w writer) error {
 	return w(true, controlifx.StateVersionType, &implifx.StateVersionLanMessage{
-		Vendor:  bulb.version.vendor,
-		Product: bulb.version.product,
-		Version: bulb.version.version,
+		Vendor:  o.version.vendor,
+		Product: o.version.product,
+		Version: o.version.version,
+	})
+}
+
+// now returns the time on the device's clock, in Unix nanoseconds.
+func (o *device) now() int64 {
+	return o.clk.Now().UnixNano() + o.time
+}
+
+func (o *device) getTime(w writer) error {
+	return w(true, stateTimeType, timePayload{
+		Time: o.now(),
+	})
+}
+
+func (o *device) setTime(payload *timePayload, w writer) error {
+	o.time = payload.Time - o.clk.Now().UnixNano()
+
+	return w(false, stateTimeType, timePayload{
+		Time: o.now(),
 	})
 }
 
-func getInfo(w writer) error {
-	now := time.Now().UnixNano()
+func (o *device) getInfo(w writer) error {
+	now := o.clk.Now().UnixNano()
 
 	return w(true, controlifx.StateInfoType, &implifx.StateInfoLanMessage{
-		Time:     uint64(now),
-		Uptime:   uint64(now - bulb.startTime),
-		Downtime: 0,
+		Time:     uint64(o.now()),
+		Uptime:   uint64(now - o.startTime),
+		Downtime: uint64(o.info.downtime),
 	})
 }
 
-func getLocation(w writer) error {
+func (o *device) getLocation(w writer) error {
 	return w(true, controlifx.StateLocationType, &implifx.StateLocationLanMessage{
-		Location:  bulb.location.location,
-		Label:     bulb.location.label,
-		UpdatedAt: uint64(bulb.location.updatedAt),
+		Location:  o.location.location,
+		Label:     o.location.label,
+		UpdatedAt: uint64(o.location.updatedAt),
 	})
 }
 
-func getGroup(w writer) error {
+func (o *device) getGroup(w writer) error {
 	return w(true, controlifx.StateGroupType, &implifx.StateGroupLanMessage{
-		Group:     bulb.group.group,
-		Label:     bulb.group.label,
-		UpdatedAt: uint64(bulb.group.updatedAt),
+		Group:     o.group.group,
+		Label:     o.group.label,
+		UpdatedAt: uint64(o.group.updatedAt),
 	})
 }
 
-func getOwner(w writer) error {
+func (o *device) getOwner(w writer) error {
 	return w(true, controlifx.StateOwnerType, &implifx.StateOwnerLanMessage{
-		Owner:     bulb.owner.owner,
-		Label:     bulb.owner.label,
-		UpdatedAt: uint64(bulb.owner.updatedAt),
+		Owner:     o.owner.owner,
+		Label:     o.owner.label,
+		UpdatedAt: uint64(o.owner.updatedAt),
 	})
 }
 
-func setOwner(msg implifx.ReceivableLanMessage, w writer) error {
+func (o *device) setOwner(msg implifx.ReceivableLanMessage, w writer) error {
 	payload := msg.Payload.(*implifx.SetOwnerLanMessage)
-	bulb.owner.owner = payload.Owner
-	bulb.owner.label = payload.Label
-	bulb.owner.updatedAt = time.Now().UnixNano()
+	o.owner.owner = payload.Owner
+	o.owner.label = payload.Label
+	o.owner.updatedAt = o.clk.Now().UnixNano()
 
 	return w(false, controlifx.StateOwnerType, &implifx.StateOwnerLanMessage{
-		Owner:     bulb.owner.owner,
-		Label:     bulb.owner.label,
-		UpdatedAt: uint64(bulb.owner.updatedAt),
+		Owner:     o.owner.owner,
+		Label:     o.owner.label,
+		UpdatedAt: uint64(o.owner.updatedAt),
 	})
 }
 
-func echoRequest(msg implifx.ReceivableLanMessage, w writer) error {
+func (o *device) echoRequest(msg implifx.ReceivableLanMessage, w writer) error {
 	return w(true, controlifx.EchoResponseType, &implifx.EchoResponseLanMessage{
 		Payload: msg.Payload.(*implifx.EchoRequestLanMessage).Payload,
 	})
 }
 
-func lightGet(w writer) error {
+func (o *device) lightGet(w writer) error {
 	return w(true, controlifx.LightStateType, &implifx.LightStateLanMessage{
-		Color: bulb.state.color,
-		Power: bulb.powerLevel,
-		Label: bulb.label,
+		Color: o.state.color,
+		Power: o.currentPower(),
+		Label: o.label,
 	})
 }
 
-func lightSetColor(msg implifx.ReceivableLanMessage, w writer) error {
+func (o *device) lightSetColor(msg implifx.ReceivableLanMessage, w writer) error {
 	responsePayload := &implifx.LightStateLanMessage{
-		Color: bulb.state.color,
-		Power: bulb.powerLevel,
-		Label: bulb.label,
+		Color: o.state.color,
+		Power: o.currentPower(),
+		Label: o.label,
 	}
 	payload := msg.Payload.(*implifx.LightSetColorLanMessage)
-	bulb.state.color = payload.Color
+	o.state.color = payload.Color
 
-	winActionCh <- ui.ColorAction{
-		Color:    payload.Color,
-		Duration: payload.Duration,
-	}
+	o.notify(payload.Duration)
 
 	return w(false, controlifx.LightStateType, responsePayload)
 }
 
-func lightGetPower(w writer) error {
+func (o *device) lightGetPower(w writer) error {
 	return w(true, controlifx.LightStatePowerType, &implifx.LightStatePowerLanMessage{
-		Level: bulb.powerLevel,
+		Level: o.currentPower(),
 	})
 }
 
-func lightSetPower(msg implifx.ReceivableLanMessage, w writer) error {
+func (o *device) lightSetPower(msg implifx.ReceivableLanMessage, w writer) error {
 	responsePayload := &implifx.StatePowerLanMessage{
-		Level: bulb.powerLevel,
+		Level: o.currentPower(),
 	}
 	payload := msg.Payload.(*implifx.LightSetPowerLanMessage)
-	bulb.powerLevel = payload.Level
-
-	winActionCh <- ui.PowerAction{
-		On:       bulb.powerLevel == 0xffff,
-		Duration: payload.Duration,
-	}
+	o.fadePower(payload.Level, payload.Duration)
 
 	return w(false, controlifx.LightStatePowerType, responsePayload)
 }
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding"
+	"github.com/bionicrm/emulifx/clock"
+	"gopkg.in/lifx-tools/implifx.v1"
+	"testing"
+	"time"
+)
+
+// epoch is when fake clocks in tests start.
+var epoch = time.Unix(1500000000, 0)
+
+// newTestDevice returns a device on a loopback socket, driven by a fake
+// clock.
+func newTestDevice(t testing.TB, cfg Config) (*device, *clock.Fake) {
+	t.Helper()
+
+	clk := clock.NewFake(epoch)
+	cfg.Addr = "127.0.0.1:0"
+	cfg.Clock = clk
+	cfg.Headless = true
+
+	conn, err := listen(cfg.Addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return newDevice(cfg, conn), clk
+}
+
+// waitFor calls advance, if set, until ok reports true, failing t if that
+// takes over a second.
+func waitFor(t testing.TB, what string, ok func() bool, advance func()) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); !ok(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		if advance != nil {
+			advance()
+		}
+	}
+}
+
+// capture returns a writer that keeps the last payload written.
+func capture(payload *encoding.BinaryMarshaler) writer {
+	return func(always bool, t uint16, msg encoding.BinaryMarshaler) error {
+		*payload = msg
+		return nil
+	}
+}
+
+func TestGetInfoUptime(t *testing.T) {
+	dev, clk := newTestDevice(t, Config{})
+
+	clk.Advance(90 * time.Second)
+
+	var payload encoding.BinaryMarshaler
+	if err := dev.getInfo(capture(&payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	info := payload.(*implifx.StateInfoLanMessage)
+	if want := uint64(90 * time.Second); info.Uptime != want {
+		t.Errorf("uptime = %d, want %d", info.Uptime, want)
+	}
+	if want := uint64(epoch.Add(90 * time.Second).UnixNano()); info.Time != want {
+		t.Errorf("time = %d, want %d", info.Time, want)
+	}
+	if info.Downtime != 0 {
+		t.Errorf("downtime = %d, want 0", info.Downtime)
+	}
+}
+
+func TestGetInfoUptimeAfterReboot(t *testing.T) {
+	dev, clk := newTestDevice(t, Config{BootTime: 5 * time.Second})
+
+	// The device comes back by posting to its loop, which isn't running.
+	dev.events = make(chan func(), 1)
+
+	clk.Advance(time.Minute)
+	dev.update(func() {
+		dev.goOffline(dev.cfg.bootTime(), true)
+	})
+
+	clk.Advance(5 * time.Second)
+	dev.update(<-dev.events)
+	clk.Advance(10 * time.Second)
+
+	var info *implifx.StateInfoLanMessage
+	dev.update(func() {
+		var payload encoding.BinaryMarshaler
+		if err := dev.getInfo(capture(&payload)); err != nil {
+			t.Fatal(err)
+		}
+		info = payload.(*implifx.StateInfoLanMessage)
+	})
+
+	if want := uint64(10 * time.Second); info.Uptime != want {
+		t.Errorf("uptime = %d, want %d", info.Uptime, want)
+	}
+	if want := uint64(5 * time.Second); info.Downtime != want {
+		t.Errorf("downtime = %d, want %d", info.Downtime, want)
+	}
+}
+
+func TestSetOwnerUpdatedAt(t *testing.T) {
+	dev, clk := newTestDevice(t, Config{})
+
+	clk.Advance(time.Hour)
+
+	var payload encoding.BinaryMarshaler
+	msg := implifx.ReceivableLanMessage{
+		Payload: &implifx.SetOwnerLanMessage{
+			Owner: [16]byte{1, 2, 3},
+			Label: "home",
+		},
+	}
+	if err := dev.setOwner(msg, capture(&payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := epoch.Add(time.Hour).UnixNano()
+	if dev.owner.updatedAt != want {
+		t.Errorf("updatedAt = %d, want %d", dev.owner.updatedAt, want)
+	}
+	if got := payload.(*implifx.StateOwnerLanMessage).UpdatedAt; got != uint64(want) {
+		t.Errorf("StateOwner updatedAt = %d, want %d", got, want)
+	}
+}
+
+func TestDevicesKeepTheirOwnClocks(t *testing.T) {
+	a, clkA := newTestDevice(t, Config{})
+	b, _ := newTestDevice(t, Config{})
+
+	clkA.Advance(time.Minute)
+
+	if got := a.clk.Now(); !got.Equal(epoch.Add(time.Minute)) {
+		t.Errorf("first device's clock reads %v", got)
+	}
+	if got := b.clk.Now(); !got.Equal(epoch) {
+		t.Errorf("second device's clock moved with the first's, reads %v", got)
+	}
+
+	c := newDevice(Config{}, a.conn)
+	if c.clk != clock.Real {
+		t.Error("device without a configured clock doesn't use the wall clock")
+	}
+}
+
+func TestMembersDriftApart(t *testing.T) {
+	cfg := Config{RandomMAC: true, Faults: Faults{Seed: 7, Drop: 0.5}}
+
+	seeds := make(map[int64]bool)
+	readings := make(map[float64]bool)
+	for i := 0; i < 3; i++ {
+		member := memberConfig(cfg, i, "")
+
+		seeds[member.Faults.Seed] = true
+		readings[newSensorRand(member).NormFloat64()] = true
+	}
+
+	if len(seeds) != 3 {
+		t.Errorf("members share fault seeds: %v", seeds)
+	}
+	if len(readings) != 3 {
+		t.Errorf("members' readings walk in step: %v", readings)
+	}
+}
+
+func TestGetPowerDuringFade(t *testing.T) {
+	dev, clk := newTestDevice(t, Config{})
+
+	brightness := dev.state.color.Brightness
+	dev.update(func() {
+		dev.powerLevel = 0
+		dev.fadePower(0xffff, 1000)
+	})
+
+	clk.Advance(500 * time.Millisecond)
+
+	var payload encoding.BinaryMarshaler
+	if err := dev.getPower(capture(&payload)); err != nil {
+		t.Fatal(err)
+	}
+	if got := payload.(*implifx.StatePowerLanMessage).Level; got < 0x7ffe || got > 0x8000 {
+		t.Errorf("GetPower halfway through the fade = %#x, want about 0x7fff", got)
+	}
+
+	if err := dev.lightGet(capture(&payload)); err != nil {
+		t.Fatal(err)
+	}
+	state := payload.(*implifx.LightStateLanMessage)
+	if state.Power < 0x7ffe || state.Power > 0x8000 {
+		t.Errorf("LightGet power halfway through the fade = %#x, want about 0x7fff", state.Power)
+	}
+	if state.Color.Brightness != brightness {
+		t.Errorf("fading the power changed the brightness to %#x, want %#x", state.Color.Brightness, brightness)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRSSI is the signal strength reported unless told otherwise, in
+	// dBm. It's what a bulb a room away from the access point sees.
+	DefaultRSSI = -55
+
+	// maxRSSIDrift is how far a drifting signal wanders from the configured
+	// strength, in dB.
+	maxRSSIDrift = 6
+
+	// rssiDriftRate is the standard deviation of the drift over a second.
+	rssiDriftRate = 0.5
+
+	// lossThreshold is the signal strength below which packets start
+	// getting lost, in dBm, and lossFloor is where they all are.
+	lossThreshold = -70
+	lossFloor     = -95
+)
+
+type (
+	// SignalTimeline scripts the signal strength over time, for example to
+	// degrade it from excellent to poor over five minutes:
+	//
+	//	{"Points": ["0s=-40", "5m=-85"]}
+	SignalTimeline struct {
+		// Points set the signal strength at times after the device starts,
+		// in any order. It changes linearly between points and holds after
+		// the last one.
+		Points []SignalPoint
+
+		// Walk is the standard deviation, in dB, of a random walk taken on
+		// top of the points every second, and Spread bounds how far it
+		// strays, maxRSSIDrift if unset. Drift walks gently if Walk is
+		// unset.
+		Walk   float64
+		Spread float64
+
+		// Loss makes a poor signal lose messages in both directions, on
+		// top of any configured faults.
+		Loss bool
+	}
+
+	// SignalPoint is the signal strength in dBm at a time. In flags and
+	// config files it's written as "AT=RSSI", for example "5m=-85".
+	SignalPoint struct {
+		At   time.Duration
+		RSSI float64
+	}
+)
+
+func (o *SignalPoint) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("signal point %q: missing =RSSI", text)
+	}
+
+	var err error
+	if o.At, err = time.ParseDuration(parts[0]); err != nil {
+		return fmt.Errorf("signal point %q: %s", text, err)
+	}
+	if o.RSSI, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return fmt.Errorf("signal point %q: %s", text, err)
+	}
+
+	return nil
+}
+
+func (o SignalPoint) MarshalText() ([]byte, error) {
+	return []byte(o.At.String() + "=" + strconv.FormatFloat(o.RSSI, 'g', -1, 64)), nil
+}
+
+// sorted returns a copy of o with its points in time order.
+func (o SignalTimeline) sorted() SignalTimeline {
+	o.Points = append([]SignalPoint(nil), o.Points...)
+	sort.SliceStable(o.Points, func(i, j int) bool {
+		return o.Points[i].At < o.Points[j].At
+	})
+
+	return o
+}
+
+// at returns the scripted signal strength d after the device started, or
+// base if nothing is scripted. The points must be sorted.
+func (o SignalTimeline) at(d time.Duration, base float64) float64 {
+	if len(o.Points) == 0 {
+		return base
+	}
+
+	prev := o.Points[0]
+	if d <= prev.At {
+		return prev.RSSI
+	}
+	for _, next := range o.Points[1:] {
+		if d < next.At {
+			f := float64(d-prev.At) / float64(next.At-prev.At)
+			return prev.RSSI + f*(next.RSSI-prev.RSSI)
+		}
+		prev = next
+	}
+
+	return prev.RSSI
+}
+
+// walk returns the rate and bound of the random walk, in dB.
+func (o SignalTimeline) walk(drift bool) (rate, spread float64) {
+	rate, spread = o.Walk, o.Spread
+	if rate == 0 && drift {
+		rate = rssiDriftRate
+	}
+	if spread == 0 {
+		spread = maxRSSIDrift
+	}
+
+	return
+}
+
+// newSensorRand returns the random source for a device's drifting readings.
+func newSensorRand(cfg Config) *rand.Rand {
+	seed := cfg.Faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	// Members of a fleet or gateway have seeds of their own, and mixing in
+	// the MAC keeps devices sharing a seed apart too.
+	return rand.New(rand.NewSource(seed + int64(cfg.MAC)))
+}
+
+// rssi returns the configured signal strength in dBm.
+func (o Config) rssi() float64 {
+	if o.RSSI == 0 {
+		return DefaultRSSI
+	}
+
+	return o.RSSI
+}
+
+// sampleSignal brings the reported signal strength up to date, elapsed
+// seconds after it was last sampled. It must be called from sample.
+func (o *device) sampleSignal(elapsed float64) {
+	base := o.cfg.Signal.at(time.Duration(o.sensors.at-o.sensors.since), o.cfg.rssi())
+
+	if rate, spread := o.cfg.Signal.walk(o.cfg.Drift); rate > 0 {
+		o.sensors.walk += o.sensors.rand.NormFloat64() * rate * math.Sqrt(elapsed)
+		o.sensors.walk = math.Max(-spread, math.Min(spread, o.sensors.walk))
+	}
+	o.sensors.rssi = base + o.sensors.walk
+
+	// The protocol reports the signal in milliwatts.
+	signal := float32(math.Pow(10, o.sensors.rssi/10))
+	o.wifiInfo.signal = signal
+	o.hostInfo.signal = signal
+}
+
+// lostToSignal reports whether a message is lost to a poor signal. The loss
+// grows with the square of how far the signal is below lossThreshold. It must
+// be called with the device locked, or read locked and readings held.
+func (o *device) lostToSignal() bool {
+	if !o.cfg.Signal.Loss {
+		return false
+	}
+
+	o.sample()
+	if o.sensors.rssi >= lossThreshold {
+		return false
+	}
+
+	f := (lossThreshold - o.sensors.rssi) / (lossThreshold - lossFloor)
+	return o.sensors.rand.Float64() < f*f
+}
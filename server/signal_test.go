@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignalTimelineOutOfOrder(t *testing.T) {
+	dev, _ := newTestDevice(t, Config{
+		Signal: SignalTimeline{
+			Points: []SignalPoint{
+				{At: 10 * time.Minute, RSSI: -80},
+				{At: 0, RSSI: -40},
+				{At: 5 * time.Minute, RSSI: -60},
+			},
+		},
+	})
+
+	for _, test := range []struct {
+		d    time.Duration
+		want float64
+	}{
+		{0, -40},
+		{150 * time.Second, -50},
+		{5 * time.Minute, -60},
+		{450 * time.Second, -70},
+		{time.Hour, -80},
+	} {
+		if got := dev.cfg.Signal.at(test.d, DefaultRSSI); got != test.want {
+			t.Errorf("at(%s) = %g, want %g", test.d, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// persistedState is what a real bulb keeps in flash across power cycles.
+type persistedState struct {
+	Label      string
+	PowerLevel uint16
+	Color      controlifx.HSBK
+
+	// MAC is only kept for devices with a random address, so that it stays
+	// the same from run to run.
+	MAC uint64 `json:",omitempty"`
+
+	Location          [16]byte
+	LocationLabel     string
+	LocationUpdatedAt int64
+
+	Group          [16]byte
+	GroupLabel     string
+	GroupUpdatedAt int64
+
+	Owner          [16]byte
+	OwnerLabel     string
+	OwnerUpdatedAt int64
+
+	// WanAuthKey is set once the device has been claimed.
+	WanAuthKey [32]byte
+
+	// SSID is the network an onboarded device joined.
+	SSID string `json:",omitempty"`
+}
+
+// loadState reads the state file at path, if it exists, into the device.
+func (o *device) loadState(path string) error {
+	o.persisted.path = path
+	o.persisted.state = o.persistentState()
+
+	if path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, &o.persisted.state); err != nil {
+		return err
+	}
+	o.restoreState()
+
+	return nil
+}
+
+// saveState persists the device's state if it has changed since it was last
+// saved.
+func (o *device) saveState() {
+	state := o.persistentState()
+	if state == o.persisted.state {
+		return
+	}
+	o.persisted.state = state
+
+	if o.persisted.path == "" {
+		return
+	}
+
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		o.log.Println(err)
+		return
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated
+	// state file behind.
+	tmp := filepath.Join(filepath.Dir(o.persisted.path), "."+filepath.Base(o.persisted.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		o.log.Println(err)
+		return
+	}
+	if err := os.Rename(tmp, o.persisted.path); err != nil {
+		o.log.Println(err)
+	}
+}
+
+// restoreState puts the device back to its last persisted state, cutting
+// short any fade.
+func (o *device) restoreState() {
+	s := o.persisted.state
+
+	o.power.duration = 0
+
+	o.label = s.Label
+	o.powerLevel = s.PowerLevel
+	o.state.color = s.Color
+	o.location.location = s.Location
+	o.location.label = s.LocationLabel
+	o.location.updatedAt = s.LocationUpdatedAt
+	o.group.group = s.Group
+	o.group.label = s.GroupLabel
+	o.group.updatedAt = s.GroupUpdatedAt
+	o.owner.owner = s.Owner
+	o.owner.label = s.OwnerLabel
+	o.owner.updatedAt = s.OwnerUpdatedAt
+	o.wanAuthKey = s.WanAuthKey
+
+	if o.cfg.RandomMAC && s.MAC != 0 {
+		o.mac = s.MAC
+	}
+
+	if o.cfg.Unconfigured {
+		o.wifiAccessPoint.ssid = s.SSID
+		o.unconfigured = s.SSID == ""
+		if o.unconfigured {
+			o.wifi.status = wifiStatusOff
+		} else {
+			o.wifi.status = wifiStatusConnected
+		}
+	}
+}
+
+func (o *device) persistentState() persistedState {
+	var mac uint64
+	if o.cfg.RandomMAC {
+		mac = o.mac
+	}
+
+	var ssid string
+	if o.cfg.Unconfigured && !o.unconfigured {
+		ssid = o.wifiAccessPoint.ssid
+	}
+
+	return persistedState{
+		MAC:               mac,
+		SSID:              ssid,
+		Label:             o.label,
+		PowerLevel:        o.powerLevel,
+		Color:             o.state.color,
+		Location:          o.location.location,
+		LocationLabel:     o.location.label,
+		LocationUpdatedAt: o.location.updatedAt,
+		Group:             o.group.group,
+		GroupLabel:        o.group.label,
+		GroupUpdatedAt:    o.group.updatedAt,
+		Owner:             o.owner.owner,
+		OwnerLabel:        o.owner.label,
+		OwnerUpdatedAt:    o.owner.updatedAt,
+		WanAuthKey:        o.wanAuthKey,
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Swarm configures a large number of devices for load testing discovery.
+	Swarm struct {
+		Count int
+
+		// Each device takes a fixed time to respond, drawn from a normal
+		// distribution with mean Latency and standard deviation Spread, so
+		// that responses trickle in as they would from a real network.
+		Latency time.Duration
+		Spread  time.Duration
+	}
+
+	// swarmStats counts what the swarm received.
+	swarmStats struct {
+		mu sync.Mutex
+
+		received   uint64
+		duplicates uint64
+
+		// requests counts the messages from each client, by source.
+		requests map[uint32]uint64
+
+		// last is the most recent message from each client to each
+		// target, to spot retries.
+		last map[swarmRoute]swarmMessage
+	}
+
+	swarmRoute struct {
+		source uint32
+		target uint64
+	}
+
+	swarmMessage struct {
+		sequence uint8
+		t        uint16
+	}
+)
+
+// StartSwarm runs a gateway of lightweight devices, as described by swarm,
+// until ctx is done or the socket fails. It then writes what the swarm
+// received to w.
+func StartSwarm(ctx context.Context, cfg Config, swarm Swarm, w io.Writer) error {
+	// One worker each keeps thousands of devices cheap.
+	cfg.Workers = 1
+
+	// The swarm's latencies come from the same seed as its devices.
+	if cfg.Faults.Seed == 0 {
+		cfg.Faults.Seed = time.Now().UnixNano()
+	}
+	log.Printf("swarm of %d devices with seed %d", swarm.Count, cfg.Faults.Seed)
+	rnd := rand.New(rand.NewSource(cfg.Faults.Seed))
+
+	stats := swarmStats{
+		requests: make(map[uint32]uint64),
+		last:     make(map[swarmRoute]swarmMessage),
+	}
+
+	err := runGateway(ctx, cfg, swarm.Count, func() time.Duration {
+		d := swarm.Latency + time.Duration(rnd.NormFloat64()*float64(swarm.Spread))
+		if d < 0 {
+			d = 0
+		}
+		return d
+	}, stats.observe)
+
+	stats.write(w)
+
+	return err
+}
+
+func (o *swarmStats) observe(p packet) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.received++
+	o.requests[p.header.source]++
+
+	// Clients retry with the same sequence number; the next new message
+	// gets a new one.
+	route := swarmRoute{p.header.source, p.header.target}
+	msg := swarmMessage{p.header.sequence, p.header.t}
+	if last, ok := o.last[route]; ok && last == msg {
+		o.duplicates++
+	}
+	o.last[route] = msg
+}
+
+func (o *swarmStats) write(w io.Writer) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fmt.Fprintf(w, "messages received: %d\n", o.received)
+	fmt.Fprintf(w, "duplicates:        %d\n", o.duplicates)
+	fmt.Fprintf(w, "clients:           %d\n", len(o.requests))
+
+	sources := make([]uint32, 0, len(o.requests))
+	for source := range o.requests {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return o.requests[sources[i]] > o.requests[sources[j]]
+	})
+
+	if len(sources) > 0 {
+		fmt.Fprintln(w, "requests per client:")
+	}
+	for _, source := range sources {
+		fmt.Fprintf(w, "  source %d: %d\n", source, o.requests[source])
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+// legacyTypes are the messages only legacy firmware answers.
+var legacyTypes = map[uint16]bool{
+	getTagsType:      true,
+	setTagsType:      true,
+	getTagLabelsType: true,
+	setTagLabelsType: true,
+}
+
+func (o *device) getTags(w writer) error {
+	return w(true, stateTagsType, tagsPayload{
+		Tags: o.tags.tags,
+	})
+}
+
+func (o *device) setTags(payload *tagsPayload, w writer) error {
+	o.tags.tags = payload.Tags
+	o.state.tags = payload.Tags
+
+	return w(false, stateTagsType, tagsPayload{
+		Tags: o.tags.tags,
+	})
+}
+
+// getTagLabels sends the label of each of the asked for tags that has one.
+func (o *device) getTagLabels(payload *tagsPayload, w writer) error {
+	for i, label := range o.tags.labels {
+		tag := uint64(1) << uint(i)
+		if payload.Tags&tag == 0 || label == "" {
+			continue
+		}
+
+		if err := w(true, stateTagLabelsType, tagLabelsPayload{
+			Tags:  tag,
+			Label: label,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (o *device) setTagLabels(payload *tagLabelsPayload, w writer) error {
+	for i := range o.tags.labels {
+		if payload.Tags&(1<<uint(i)) != 0 {
+			o.tags.labels[i] = payload.Label
+		}
+	}
+
+	return w(false, stateTagLabelsType, *payload)
+}
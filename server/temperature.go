@@ -0,0 +1,52 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// ambientTemperature is what the MCU settles at with the light off, in
+	// degrees Celsius.
+	ambientTemperature = 25.0
+
+	// fullTemperature is what it settles at with the light on at full
+	// brightness.
+	fullTemperature = 48.0
+
+	// warmUpTime is the time constant of the MCU warming up or cooling down.
+	warmUpTime = 8 * time.Minute
+
+	// temperatureNoise is the standard deviation of the noise on a drifting
+	// reading, in degrees Celsius.
+	temperatureNoise = 0.15
+)
+
+// sampleTemperature brings the reported MCU temperature up to date, elapsed
+// seconds after it was last sampled. It must be called from sample.
+func (o *device) sampleTemperature(elapsed float64) {
+	target := ambientTemperature + (fullTemperature-ambientTemperature)*o.load()
+
+	// Approach the target exponentially, like a body heating up.
+	o.sensors.temperature = target + (o.sensors.temperature-target)*math.Exp(-elapsed/warmUpTime.Seconds())
+
+	reading := o.sensors.temperature
+	if o.cfg.Drift {
+		reading += o.sensors.rand.NormFloat64() * temperatureNoise
+	}
+
+	// The protocol reports hundredths of a degree.
+	o.hostInfo.mcuTemperature = int16(math.Round(reading * 100))
+	o.wifiInfo.mcuTemperature = o.hostInfo.mcuTemperature
+}
+
+// sample brings the device's readings up to date. It must be called from
+// update, or with the device read locked and readings held.
+func (o *device) sample() {
+	now := o.clk.Now().UnixNano()
+	elapsed := time.Duration(now - o.sensors.at).Seconds()
+	o.sensors.at = now
+
+	o.sampleSignal(elapsed)
+	o.sampleTemperature(elapsed)
+}
@@ -0,0 +1,25 @@
+package server
+
+import "time"
+
+// Throttle models the limited processing budget of real firmware, which
+// starts dropping messages at around 20 per second.
+type Throttle struct {
+	// Rate is how many messages per second the device processes. Messages
+	// are processed one at a time, and the device rests for 1/Rate seconds
+	// after each. Zero disables throttling.
+	Rate float64
+
+	// Depth is how many messages may wait to be processed. Messages that
+	// arrive while the queue is full are dropped.
+	Depth int
+}
+
+func (o Throttle) enabled() bool {
+	return o.Rate > 0
+}
+
+// cost is how long the device stays busy after processing a single message.
+func (o Throttle) cost() time.Duration {
+	return time.Duration(float64(time.Second) / o.Rate)
+}
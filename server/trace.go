@@ -0,0 +1,38 @@
+package server
+
+import (
+	"log"
+	"net"
+)
+
+const (
+	dropFault    = "fault"
+	dropOffline  = "offline"
+	dropThrottle = "throttle"
+	dropTarget   = "target"
+	dropSignal   = "signal"
+)
+
+// tracing enables a log line for every message received, sent or dropped.
+var tracing bool
+
+func traceReceive(p packet) {
+	if tracing {
+		log.Printf("rx type=%d source=%d seq=%d from=%s", p.header.t, p.header.source, p.header.sequence, p.raddr)
+	}
+}
+
+func traceSend(t uint16, n int, raddr *net.UDPAddr) {
+	if tracing {
+		log.Printf("tx type=%d bytes=%d to=%s", t, n, raddr)
+	}
+}
+
+// drop records that p was not processed, and why.
+func drop(p packet, reason string) {
+	metrics.drop(reason)
+
+	if tracing {
+		log.Printf("drop (%s) type=%d source=%d seq=%d from=%s", reason, p.header.t, p.header.source, p.header.sequence, p.raddr)
+	}
+}
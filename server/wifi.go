@@ -0,0 +1,156 @@
+package server
+
+import (
+	"gopkg.in/lifx-tools/controlifx.v1"
+	"net"
+	"time"
+)
+
+const (
+	wifiInterfaceSoftAP  uint8 = 1
+	wifiInterfaceStation uint8 = 2
+
+	wifiStatusConnecting uint8 = 0
+	wifiStatusConnected  uint8 = 1
+	wifiStatusFailed     uint8 = 2
+	wifiStatusOff        uint8 = 3
+
+	// WPA2Security is the most common kind of access point security.
+	WPA2Security uint8 = 5
+
+	// joinTime is how long joining an access point takes.
+	joinTime = 3 * time.Second
+)
+
+// softAPAddr is the device's address on its own access point.
+var softAPAddr = [4]byte{172, 16, 0, 1}
+
+// AccessPoint is a network an unconfigured device can see. An empty Password
+// accepts any.
+type AccessPoint struct {
+	SSID     string
+	Password string
+	Security uint8
+	Strength int16
+	Channel  uint16
+}
+
+// DefaultAccessPoints are what an unconfigured device sees unless told
+// otherwise.
+var DefaultAccessPoints = []AccessPoint{
+	{SSID: "Home", Security: WPA2Security, Strength: -45, Channel: 6},
+	{SSID: "Neighbour", Security: WPA2Security, Strength: -78, Channel: 11},
+}
+
+// onboardingTypes are the messages an unconfigured device answers.
+var onboardingTypes = map[uint16]bool{
+	controlifx.GetServiceType: true,
+	controlifx.GetVersionType: true,
+	wifiGetType:               true,
+	wifiSetType:               true,
+	wifiGetAccessPointsType:   true,
+	wifiSetAccessPointType:    true,
+}
+
+func (o Config) accessPoints() []AccessPoint {
+	if len(o.AccessPoints) == 0 {
+		return DefaultAccessPoints
+	}
+
+	return o.AccessPoints
+}
+
+func (o *device) wifiGet(payload *wifiGetPayload, w writer) error {
+	return w(true, wifiStateType, o.wifiState(payload.Interface))
+}
+
+// wifiSet only reports the interface's state. Interfaces are switched by
+// onboarding.
+func (o *device) wifiSet(payload *wifiSetPayload, w writer) error {
+	return w(false, wifiStateType, o.wifiState(payload.Interface))
+}
+
+func (o *device) wifiState(iface uint8) wifiStatePayload {
+	state := wifiStatePayload{
+		Interface: iface,
+		Status:    wifiStatusOff,
+	}
+
+	switch iface {
+	case wifiInterfaceSoftAP:
+		if o.unconfigured {
+			state.Status = wifiStatusConnected
+			state.IP4 = softAPAddr
+		}
+	case wifiInterfaceStation:
+		state.Status = o.wifi.status
+		if state.Status == wifiStatusConnected {
+			if ip := o.conn.LocalAddr().(*net.UDPAddr).IP.To4(); ip != nil {
+				copy(state.IP4[:], ip)
+			}
+		}
+	}
+
+	return state
+}
+
+func (o *device) wifiGetAccessPoints(w writer) error {
+	for _, ap := range o.cfg.accessPoints() {
+		if err := w(true, wifiStateAccessPointType, accessPointPayload{
+			Interface: wifiInterfaceStation,
+			SSID:      ap.SSID,
+			Security:  ap.Security,
+			Strength:  ap.Strength,
+			Channel:   ap.Channel,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// wifiSetAccessPoint starts joining the network given. The device stays
+// unconfigured until it has joined.
+func (o *device) wifiSetAccessPoint(payload *setAccessPointPayload, w writer) error {
+	o.wifiAccessPoint.networkInterface = int8(payload.Interface)
+	o.wifiAccessPoint.ssid = payload.SSID
+	o.wifiAccessPoint.pass = payload.Password
+	o.wifiAccessPoint.security = int8(payload.Security)
+	o.wifi.networkInterface = int8(wifiInterfaceStation)
+	o.wifi.status = wifiStatusConnecting
+
+	o.log.Printf("joining %q", payload.SSID)
+	o.clk.AfterFunc(joinTime, func() {
+		o.post(o.join)
+	})
+
+	return w(false, wifiStateType, o.wifiState(wifiInterfaceStation))
+}
+
+// join finishes joining the network set by wifiSetAccessPoint. It must be
+// called from update.
+func (o *device) join() {
+	// Another attempt may have started since.
+	if o.wifi.status != wifiStatusConnecting {
+		return
+	}
+
+	ap := o.wifiAccessPoint
+	for _, candidate := range o.cfg.accessPoints() {
+		if candidate.SSID != ap.ssid || candidate.Security != uint8(ap.security) {
+			continue
+		}
+		if candidate.Password != "" && candidate.Password != ap.pass {
+			break
+		}
+
+		o.log.Printf("joined %q", ap.ssid)
+		o.wifi.status = wifiStatusConnected
+		o.unconfigured = false
+		return
+	}
+
+	o.log.Printf("failed to join %q", ap.ssid)
+	o.wifi.status = wifiStatusFailed
+}
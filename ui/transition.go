@@ -0,0 +1,43 @@
+package ui
+
+// transition linearly interpolates a value over time. Times are in Unix
+// nanoseconds.
+type transition struct {
+	from, to, change int32
+	start, duration  int64
+}
+
+func newTransition(from, to int32, start, duration int64) transition {
+	return transition{
+		from:     from,
+		to:       to,
+		change:   to - from,
+		start:    start,
+		duration: duration,
+	}
+}
+
+// newHueTransition is like newTransition, but takes the shortest way around
+// the color wheel.
+func newHueTransition(from, to int32, start, duration int64) transition {
+	t := newTransition(from, to, start, duration)
+
+	if abs(t.change) > 0xffff/2 {
+		if t.change > 0 {
+			t.change -= 0xffff
+		} else {
+			t.change += 0xffff
+		}
+	}
+
+	return t
+}
+
+// at returns the value at time now.
+func (o transition) at(now int64) int32 {
+	if now < o.start+o.duration {
+		return lerp(o.start, o.duration, now, o.from, o.change)
+	}
+
+	return o.to
+}
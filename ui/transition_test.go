@@ -0,0 +1,56 @@
+package ui
+
+import "testing"
+
+func TestTransitionAt(t *testing.T) {
+	tr := newTransition(100, 300, 1000, 200)
+
+	tests := []struct {
+		now  int64
+		want int32
+	}{
+		{1000, 100},
+		{1050, 150},
+		{1100, 200},
+		{1199, 299},
+		{1200, 300},
+		{5000, 300},
+	}
+	for _, test := range tests {
+		if got := tr.at(test.now); got != test.want {
+			t.Errorf("at(%d) = %d, want %d", test.now, got, test.want)
+		}
+	}
+}
+
+func TestTransitionAtZeroDuration(t *testing.T) {
+	tr := newTransition(100, 300, 1000, 0)
+
+	if got := tr.at(1000); got != 300 {
+		t.Errorf("at(start) = %d, want 300", got)
+	}
+}
+
+func TestHueTransitionTakesShortestWay(t *testing.T) {
+	tests := []struct {
+		from, to int32
+		change   int32
+	}{
+		{0x1000, 0x2000, 0x1000},
+		{0x2000, 0x1000, -0x1000},
+
+		// Across zero rather than all the way round.
+		{0x1000, 0xf000, 0xe000 - 0xffff},
+		{0xf000, 0x1000, 0xffff - 0xe000},
+	}
+
+	for _, test := range tests {
+		tr := newHueTransition(test.from, test.to, 0, 100)
+		if tr.change != test.change {
+			t.Errorf("newHueTransition(%#x, %#x).change = %#x, want %#x", test.from, test.to, tr.change, test.change)
+		}
+		if got := tr.at(100); got != test.to {
+			t.Errorf("newHueTransition(%#x, %#x).at(end) = %#x, want %#x", test.from, test.to, got, test.to)
+		}
+	}
+}
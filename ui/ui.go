@@ -3,6 +3,8 @@ package ui
 import (
 	"bytes"
 	"errors"
+	"github.com/bionicrm/emulifx/bus"
+	"github.com/bionicrm/emulifx/clock"
 	"github.com/go-gl/gl/v2.1/gl"
 	"github.com/go-gl/glfw/v3.2/glfw"
 	"gopkg.in/lifx-tools/controlifx.v1"
@@ -12,34 +14,19 @@ import (
 	"math"
 	"runtime"
 	"sync"
-	"time"
 )
 
 const (
 	Title  = "Emulifx"
 	Width  = 512
 	Height = 512
-
-	FastestBrightnessChangeDuration = 350 * 1e6
-)
-
-type (
-	PowerAction struct {
-		On       bool
-		Duration uint32
-	}
-
-	ColorAction struct {
-		Color    controlifx.HSBK
-		Duration uint32
-	}
 )
 
 func init() {
 	runtime.LockOSThread()
 }
 
-func ShowWindow(hasColor bool, laddr string, stopCh <-chan interface{}, actionCh <-chan interface{}) error {
+func ShowWindow(clk clock.Clock, hasColor bool, mac, laddr string, stopCh <-chan interface{}, lights <-chan bus.Light) error {
 	if err := glfw.Init(); err != nil {
 		return err
 	}
@@ -69,26 +56,19 @@ func ShowWindow(hasColor bool, laddr string, stopCh <-chan interface{}, actionCh
 	var (
 		colorMutex sync.Mutex
 
-		// Power.
-		bLast     int32 = 0xffff
-		poweredOn bool
-
-		// Current.
-		hCurrent, sCurrent, bCurrent, kCurrent,
-		// Start.
-		hStart, sStart, bStart, kStart,
-		// End.
-		hEnd, sEnd, bEnd, kEnd,
-		// Change.
-		hChange, sChange, bChange, kChange int32
+		// Target state.
+		powerLevel uint16
+		color      controlifx.HSBK
 
-		// Duration.
-		durationStart, duration, bDurationStart, bDuration int64
+		// Hue, saturation, brightness, Kelvin and power. The light shows
+		// the brightness scaled by the power, so fading the power leaves
+		// the color alone.
+		h, s, b, k, p transition
 
 		updateTitle = func() {
-			str := Title + " - " + laddr + " ("
+			str := Title + " - " + mac + " at " + laddr + " ("
 
-			if poweredOn {
+			if powerLevel != 0 {
 				str += "on)"
 			} else {
 				str += "off)"
@@ -99,77 +79,42 @@ func ShowWindow(hasColor bool, laddr string, stopCh <-chan interface{}, actionCh
 	)
 
 	// Initialize Kelvin.
-	kCurrent = 3500
-	kStart = kCurrent
-	kEnd = kCurrent
+	color.Kelvin = 3500
+	k = newTransition(3500, 3500, 0, 0)
 
 	updateTitle()
 
 	go func() {
 		for {
 			select {
-			case action := <-actionCh:
-				switch action.(type) {
-				case PowerAction:
-					powerAction := action.(PowerAction)
-					poweredOn = powerAction.On
-					now := time.Now()
-
-					colorMutex.Lock()
-					bDurationStart = now.UnixNano()
-					bDuration = int64(math.Max(FastestBrightnessChangeDuration, float64(durationToNano(powerAction.Duration))))
-
-					if poweredOn {
-						bStart = bCurrent
-						bEnd = bLast
-					} else {
-						bLast = bCurrent
-						bStart = bCurrent
-						bEnd = 0
-					}
-
-					bChange = bEnd - bStart
-					colorMutex.Unlock()
-
-					updateTitle()
-				case ColorAction:
-					colorAction := action.(ColorAction)
-					color := colorAction.Color
-					now := time.Now()
-
-					colorMutex.Lock()
-					hStart = hCurrent
-					sStart = sCurrent
-					bStart = bCurrent
-					kStart = kCurrent
-					hEnd = int32(color.Hue)
-					sEnd = int32(color.Saturation)
-					bEnd = int32(color.Brightness)
-					kEnd = int32(color.Kelvin)
-					hChange = hEnd - hStart
-					sChange = sEnd - sStart
-					bChange = bEnd - bStart
-					kChange = kEnd - kStart
-
-					// Hue change takes the shortest
-					// distance.
-					if abs(hChange) > 0xffff/2 {
-						if hChange > 0 {
-							hChange -= 0xffff
-						} else {
-							hChange += 0xffff
-						}
-					}
-
-					durationStart = now.UnixNano()
-					bDurationStart = durationStart
-					duration = durationToNano(colorAction.Duration)
-					bDuration = duration
-
-					colorMutex.Unlock()
+			case l, ok := <-lights:
+				if !ok {
+					return
+				}
+
+				now := clk.Now().UnixNano()
+				duration := durationToNano(l.Duration)
+
+				colorMutex.Lock()
+				if l.Color != color {
+					h = newHueTransition(h.at(now), int32(l.Color.Hue), now, duration)
+					s = newTransition(s.at(now), int32(l.Color.Saturation), now, duration)
+					b = newTransition(b.at(now), int32(l.Color.Brightness), now, duration)
+					k = newTransition(k.at(now), int32(l.Color.Kelvin), now, duration)
 				}
+
+				if l.PowerLevel != powerLevel {
+					p = newTransition(p.at(now), int32(l.PowerLevel), now, duration)
+				}
+
+				powerLevel = l.PowerLevel
+				color = l.Color
+				colorMutex.Unlock()
+
+				updateTitle()
 			case <-stopCh:
 				win.SetShouldClose(true)
+				return
 			}
 		}
 	}()
@@ -185,26 +130,11 @@ func ShowWindow(hasColor bool, laddr string, stopCh <-chan interface{}, actionCh
 	gl.BlendFunc(gl.SRC_ALPHA, gl.ONE_MINUS_SRC_ALPHA)
 
 	for !win.ShouldClose() {
-		now := time.Now().UnixNano()
+		now := clk.Now().UnixNano()
 
 		colorMutex.Lock()
-		// Hue, saturation, and Kelvin linear interpolation.
-		if now < durationStart+duration {
-			hCurrent = lerp(durationStart, duration, now, hStart, hChange)
-			sCurrent = lerp(durationStart, duration, now, sStart, sChange)
-			kCurrent = lerp(durationStart, duration, now, kStart, kChange)
-		} else {
-			hCurrent = hEnd
-			sCurrent = sEnd
-			kCurrent = kEnd
-		}
-
-		// Brightness linear interpolation.
-		if now < bDurationStart+bDuration {
-			bCurrent = lerp(bDurationStart, bDuration, now, bStart, bChange)
-		} else {
-			bCurrent = bEnd
-		}
+		hCurrent, sCurrent, kCurrent := h.at(now), s.at(now), k.at(now)
+		bCurrent := int32(int64(b.at(now)) * int64(p.at(now)) / 0xffff)
 
 		if hasColor {
 			setColor(float32(hCurrent)/0xffff, float32(sCurrent)/0xffff, float32(bCurrent)/0xffff/2, float32(kCurrent))